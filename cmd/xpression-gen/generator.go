@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/types"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// field is a resolvable path of the struct
+type field struct {
+	path      string   // dotted path as written in an expression, e.g. "address.city"
+	access    string   // Go expression, e.g. "v.Address.City"
+	nilChecks []string // pointers to check before the access
+	set       string   // statement setting the result
+}
+
+// setters of basic types
+var basicSetters = map[string]string{
+	"string":  "result.SetString(string(%s))",
+	"bool":    "result.SetBoolean(bool(%s))",
+	"int":     "result.SetNumber(float64(%s))",
+	"int8":    "result.SetNumber(float64(%s))",
+	"int16":   "result.SetNumber(float64(%s))",
+	"int32":   "result.SetNumber(float64(%s))",
+	"int64":   "result.SetNumber(float64(%s))",
+	"uint":    "result.SetNumber(float64(%s))",
+	"uint8":   "result.SetNumber(float64(%s))",
+	"uint16":  "result.SetNumber(float64(%s))",
+	"uint32":  "result.SetNumber(float64(%s))",
+	"uint64":  "result.SetNumber(float64(%s))",
+	"uintptr": "result.SetNumber(float64(%s))",
+	"byte":    "result.SetNumber(float64(%s))",
+	"rune":    "result.SetNumber(float64(%s))",
+	"float32": "result.SetNumber(float64(%s))",
+	"float64": "result.SetNumber(%s)",
+}
+
+// generate returns the source of the resolvers for the types along with warnings about the fields
+// which can not be resolved.
+func generate(pkg *goPackage, types []string) ([]byte, []string, error) {
+	var buf bytes.Buffer
+	var warnings []string
+	fmt.Fprintf(&buf, "// Code generated by xpression-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg.name)
+	fmt.Fprintf(&buf, "import (\n\t\"fmt\"\n\n\t\"github.com/bhmj/xpression\"\n)\n")
+	for _, name := range types {
+		st, ok := pkg.types[name].(*ast.StructType)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not a struct type", name)
+		}
+		pkg.skipped = pkg.skipped[:0]
+		fields := pkg.fields(st, "", "v", nil, map[string]bool{name: true})
+		for _, skipped := range pkg.skipped {
+			warnings = append(warnings, fmt.Sprintf("%s.%s: unsupported type, the field is skipped", name, skipped))
+		}
+		writeResolver(&buf, name, unique(fields))
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("format generated code: %w", err)
+	}
+	return src, warnings, nil
+}
+
+// fields collects resolvable paths of the struct. Nested structs of the package are walked recursively,
+// embedded structs are promoted. Fields of unsupported types are skipped and recorded in pkg.skipped.
+func (pkg *goPackage) fields(st *ast.StructType, prefix, access string, nilChecks []string, visiting map[string]bool) []field {
+	var result, promoted []field
+	known := make(map[string]bool)
+	for _, f := range st.Fields.List {
+		name, tagged := "", false
+		if f.Tag != nil {
+			tag, _ := strconv.Unquote(f.Tag.Value)
+			name, tagged = tagName(reflect.StructTag(tag))
+		}
+		if name == "-" {
+			continue
+		}
+		names := make([]string, 0, len(f.Names))
+		for _, n := range f.Names {
+			names = append(names, n.Name)
+		}
+		if len(f.Names) == 0 { // embedded
+			typeName, pointer := namedType(f.Type)
+			if typeName == "" {
+				pkg.skip(prefix+types.ExprString(f.Type), f.Type)
+				continue
+			}
+			if nested, ok := pkg.types[typeName].(*ast.StructType); ok && !tagged && !visiting[typeName] {
+				checks := nilChecks
+				if pointer {
+					checks = appendCopy(nilChecks, access+"."+typeName)
+				}
+				visiting[typeName] = true
+				promoted = append(promoted, pkg.fields(nested, prefix, access+"."+typeName, checks, visiting)...)
+				delete(visiting, typeName)
+				continue
+			}
+			names = append(names, typeName)
+		}
+		for _, goName := range names {
+			if !ast.IsExported(goName) {
+				continue
+			}
+			path := goName
+			if tagged {
+				path = name
+			}
+			fields := pkg.field(f.Type, prefix+path, access+"."+goName, nilChecks, visiting)
+			if len(fields) == 0 {
+				pkg.skip(prefix+path, f.Type)
+			}
+			for _, fld := range fields {
+				known[fld.path] = true
+			}
+			result = append(result, fields...)
+		}
+	}
+	for _, fld := range promoted {
+		if !known[fld.path] {
+			result = append(result, fld)
+		}
+	}
+	return result
+}
+
+// field returns resolvable paths for the field of given type
+func (pkg *goPackage) field(typ ast.Expr, path, access string, nilChecks []string, visiting map[string]bool) []field {
+	switch t := typ.(type) {
+	case *ast.Ident:
+		if setter, ok := basicSetters[t.Name]; ok {
+			return []field{{path: path, access: access, nilChecks: nilChecks, set: fmt.Sprintf(setter, access)}}
+		}
+		switch underlying := pkg.types[t.Name].(type) {
+		case *ast.Ident:
+			if setter, ok := basicSetters[underlying.Name]; ok {
+				return []field{{path: path, access: access, nilChecks: nilChecks, set: fmt.Sprintf(setter, access)}}
+			}
+		case *ast.StructType:
+			result := []field{{path: path, access: access, nilChecks: nilChecks, set: fmt.Sprintf("result.SetObject(%s)", access)}}
+			if !visiting[t.Name] {
+				visiting[t.Name] = true
+				result = append(result, pkg.fields(underlying, path+".", access, nilChecks, visiting)...)
+				delete(visiting, t.Name)
+			}
+			return result
+		}
+	case *ast.StarExpr:
+		ident, ok := t.X.(*ast.Ident)
+		if !ok {
+			return nil
+		}
+		if underlying, ok := pkg.types[ident.Name].(*ast.StructType); ok {
+			result := []field{{path: path, access: access, nilChecks: nilChecks, set: nilOrObject(access)}}
+			if !visiting[ident.Name] {
+				visiting[ident.Name] = true
+				result = append(result, pkg.fields(underlying, path+".", access, appendCopy(nilChecks, access), visiting)...)
+				delete(visiting, ident.Name)
+			}
+			return result
+		}
+	case *ast.ArrayType, *ast.MapType:
+		if at, ok := t.(*ast.ArrayType); ok && at.Len != nil {
+			return []field{{path: path, access: access, nilChecks: nilChecks, set: fmt.Sprintf("result.SetObject(%s)", access)}}
+		}
+		return []field{{path: path, access: access, nilChecks: nilChecks, set: nilOrObject(access)}}
+	}
+	return nil
+}
+
+// skip records a field of unsupported type
+func (pkg *goPackage) skip(path string, typ ast.Expr) {
+	pkg.skipped = append(pkg.skipped, fmt.Sprintf("%s (%s)", path, types.ExprString(typ)))
+}
+
+func nilOrObject(access string) string {
+	return fmt.Sprintf("if %[1]s == nil {\nresult.SetNull()\n} else {\nresult.SetObject(%[1]s)\n}", access)
+}
+
+func writeResolver(buf *bytes.Buffer, name string, fields []field) {
+	resolver := name + "Resolver"
+	fmt.Fprintf(buf, "\n// %s resolves variables against %s without reflection.\n", resolver, name)
+	fmt.Fprintf(buf, "type %s struct {\n\tValue *%s\n}\n", resolver, name)
+
+	fmt.Fprintf(buf, "\n// Resolve implements xpression.Resolver.\n")
+	fmt.Fprintf(buf, "func (r *%s) Resolve(name []byte, result *xpression.Operand) error {\n", resolver)
+	fmt.Fprintf(buf, "v := r.Value\nif v == nil {\nresult.SetUndefined()\nreturn nil\n}\n")
+	fmt.Fprintf(buf, "switch string(name) {\n")
+	for _, f := range fields {
+		fmt.Fprintf(buf, "case %s:\n", caseLabels(f.path))
+		for _, check := range f.nilChecks {
+			fmt.Fprintf(buf, "if %s == nil {\nresult.SetUndefined()\nreturn nil\n}\n", check)
+		}
+		fmt.Fprintf(buf, "%s\n", f.set)
+	}
+	fmt.Fprintf(buf, "default:\nreturn fmt.Errorf(\"%%w: %%s\", xpression.ErrInvalidPath, name)\n}\nreturn nil\n}\n")
+
+	fmt.Fprintf(buf, "\n// Validate checks that the expression only references fields of %s.\n", name)
+	fmt.Fprintf(buf, "func (r *%s) Validate(expression []byte) error {\n", resolver)
+	fmt.Fprintf(buf, "vars, err := xpression.Variables(expression)\nif err != nil {\nreturn err\n}\n")
+	fmt.Fprintf(buf, "for _, v := range vars {\nswitch v.Name {\n")
+	if len(fields) > 0 {
+		labels := make([]string, 0, len(fields))
+		for _, f := range fields {
+			labels = append(labels, caseLabels(f.path))
+		}
+		fmt.Fprintf(buf, "case %s:\n", strings.Join(labels, ",\n"))
+	}
+	fmt.Fprintf(buf, "default:\n")
+	fmt.Fprintf(buf, "return &xpression.SyntaxError{Err: xpression.ErrInvalidPath, Position: v.Pos, Token: v.Name, Source: string(expression)}\n")
+	fmt.Fprintf(buf, "}\n}\nreturn nil\n}\n")
+}
+
+// caseLabels returns the path as a bare name and prefixed with `@.` and `$.`
+func caseLabels(path string) string {
+	return fmt.Sprintf("%q, %q, %q", path, "@."+path, "$."+path)
+}
+
+// tagName returns the name defined by `xpr` or `json` tag
+func tagName(tag reflect.StructTag) (string, bool) {
+	for _, key := range []string{"xpr", "json"} {
+		if value, found := tag.Lookup(key); found {
+			name := strings.Split(value, ",")[0]
+			if name != "" {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// namedType returns the name of a package-level type, possibly behind a pointer
+func namedType(typ ast.Expr) (string, bool) {
+	pointer := false
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ, pointer = star.X, true
+	}
+	if ident, ok := typ.(*ast.Ident); ok {
+		return ident.Name, pointer
+	}
+	return "", false
+}
+
+func appendCopy(s []string, elem string) []string {
+	return append(append([]string{}, s...), elem)
+}
+
+// unique drops fields with duplicate paths keeping the first one
+func unique(fields []field) []field {
+	seen := make(map[string]bool, len(fields))
+	result := fields[:0]
+	for _, f := range fields {
+		if !seen[f.path] {
+			seen[f.path] = true
+			result = append(result, f)
+		}
+	}
+	return result
+}
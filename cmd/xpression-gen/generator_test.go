@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func Test_Generate(t *testing.T) {
+	dir := filepath.Join("testdata", "order")
+	output := filepath.Join(dir, "xpression_resolvers.go")
+	pkg, err := loadPackage(dir, filepath.Base(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, warnings, err := generate(pkg, pkg.annotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile(output, src, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, golden) {
+		t.Errorf("generated code differs from %s, run `go test -update` to update it", output)
+	}
+
+	expected := []string{
+		"Order.created (time.Time): unsupported type, the field is skipped",
+		"Order.note (*string): unsupported type, the field is skipped",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("warnings\n\texpected `%s`\n\tbut got  `%s`", strings.Join(expected, "`, `"), strings.Join(warnings, "`, `"))
+	}
+}
+
+func Test_GenerateCompiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping compilation in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	out, err := exec.Command(goTool, "vet", "./testdata/order").CombinedOutput()
+	if err != nil {
+		t.Errorf("generated code does not compile: %v\n%s", err, out)
+	}
+}
+
+func Test_GenerateNotStruct(t *testing.T) {
+	pkg, err := loadPackage(filepath.Join("testdata", "order"), "xpression_resolvers.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := generate(pkg, []string{"Status"}); err == nil || err.Error() != "Status is not a struct type" {
+		t.Errorf("Status\n\texpected `Status is not a struct type`\n\tbut got  `%v`", err)
+	}
+}
@@ -0,0 +1,142 @@
+// xpression-gen generates resolvers for struct types which map variable paths to struct fields
+// without reflection or map lookups.
+//
+// Mark the types with `//xpression:resolver` comment or list them with -type flag
+// and add the following directive to any file of the package:
+//
+//	//go:generate xpression-gen
+//
+// For each type T the generated TResolver implements xpression.Resolver
+// and provides Validate method for checking at compile time that an expression only references existing fields.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const annotation = "xpression:resolver"
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of type names; annotated types are used if empty")
+	output := flag.String("output", "", "output file name; default <dir>/xpression_resolvers.go")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Resolver generator.\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [-type T1,T2] [-output file] [directory]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	if *output == "" {
+		*output = filepath.Join(dir, "xpression_resolvers.go")
+	}
+	var types []string
+	if *typeNames != "" {
+		types = strings.Split(*typeNames, ",")
+	}
+
+	if err := run(dir, *output, types); err != nil {
+		fmt.Fprintf(os.Stderr, "xpression-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, output string, types []string) error {
+	pkg, err := loadPackage(dir, filepath.Base(output))
+	if err != nil {
+		return err
+	}
+	if len(types) == 0 {
+		types = pkg.annotated
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("no types marked with //%s found in %s", annotation, dir)
+	}
+	src, warnings, err := generate(pkg, types)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "xpression-gen: warning: %s\n", warning)
+	}
+	return os.WriteFile(output, src, 0o644) //nolint:gosec
+}
+
+// goPackage holds type declarations of a package
+type goPackage struct {
+	name      string
+	types     map[string]ast.Expr // type name -> type expression
+	annotated []string            // types marked for generation in the order of declaration
+	skipped   []string            // fields of unsupported types found by generate
+}
+
+// loadPackage parses non-test Go files in the directory skipping the output file.
+func loadPackage(dir, skip string) (*goPackage, error) {
+	fset := token.NewFileSet()
+	filter := func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != skip
+	}
+	pkgs, err := parser.ParseDir(fset, dir, filter, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+	pkg := &goPackage{types: make(map[string]ast.Expr)}
+	for name, p := range pkgs {
+		pkg.name = name
+		files := make([]string, 0, len(p.Files))
+		for fname := range p.Files {
+			files = append(files, fname)
+		}
+		sort.Strings(files)
+		for _, fname := range files {
+			pkg.collect(p.Files[fname])
+		}
+	}
+	return pkg, nil
+}
+
+func (pkg *goPackage) collect(file *ast.File) {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			pkg.types[ts.Name.Name] = ts.Type
+			doc := ts.Doc
+			if doc == nil && len(gen.Specs) == 1 {
+				doc = gen.Doc
+			}
+			if isAnnotated(doc) {
+				pkg.annotated = append(pkg.annotated, ts.Name.Name)
+			}
+		}
+	}
+}
+
+func isAnnotated(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(strings.TrimPrefix(c.Text, "//")) == annotation {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+// Package order is a fixture for the generator tests.
+package order
+
+import "time"
+
+type Status string
+
+//xpression:resolver
+type Order struct {
+	ID       int64   `json:"id"`
+	Total    float64 `json:"total"`
+	Status   Status  `json:"status"`
+	Paid     bool
+	Customer *Customer         `json:"customer"`
+	Items    []Item            `json:"items"`
+	Tags     map[string]string `json:"tags"`
+	Created  time.Time         `json:"created"`
+	Note     *string           `json:"note"`
+	Internal string            `json:"-"`
+	Audit
+}
+
+type Customer struct {
+	Name    string  `xpr:"name"`
+	Address Address `json:"address"`
+}
+
+type Address struct {
+	City string `json:"city"`
+}
+
+type Item struct {
+	SKU string `json:"sku"`
+	Qty int    `json:"qty"`
+}
+
+type Audit struct {
+	CreatedBy string `json:"created_by"`
+}
@@ -0,0 +1,100 @@
+// Code generated by xpression-gen. DO NOT EDIT.
+
+package order
+
+import (
+	"fmt"
+
+	"github.com/bhmj/xpression"
+)
+
+// OrderResolver resolves variables against Order without reflection.
+type OrderResolver struct {
+	Value *Order
+}
+
+// Resolve implements xpression.Resolver.
+func (r *OrderResolver) Resolve(name []byte, result *xpression.Operand) error {
+	v := r.Value
+	if v == nil {
+		result.SetUndefined()
+		return nil
+	}
+	switch string(name) {
+	case "id", "@.id", "$.id":
+		result.SetNumber(float64(v.ID))
+	case "total", "@.total", "$.total":
+		result.SetNumber(v.Total)
+	case "status", "@.status", "$.status":
+		result.SetString(string(v.Status))
+	case "Paid", "@.Paid", "$.Paid":
+		result.SetBoolean(bool(v.Paid))
+	case "customer", "@.customer", "$.customer":
+		if v.Customer == nil {
+			result.SetNull()
+		} else {
+			result.SetObject(v.Customer)
+		}
+	case "customer.name", "@.customer.name", "$.customer.name":
+		if v.Customer == nil {
+			result.SetUndefined()
+			return nil
+		}
+		result.SetString(string(v.Customer.Name))
+	case "customer.address", "@.customer.address", "$.customer.address":
+		if v.Customer == nil {
+			result.SetUndefined()
+			return nil
+		}
+		result.SetObject(v.Customer.Address)
+	case "customer.address.city", "@.customer.address.city", "$.customer.address.city":
+		if v.Customer == nil {
+			result.SetUndefined()
+			return nil
+		}
+		result.SetString(string(v.Customer.Address.City))
+	case "items", "@.items", "$.items":
+		if v.Items == nil {
+			result.SetNull()
+		} else {
+			result.SetObject(v.Items)
+		}
+	case "tags", "@.tags", "$.tags":
+		if v.Tags == nil {
+			result.SetNull()
+		} else {
+			result.SetObject(v.Tags)
+		}
+	case "created_by", "@.created_by", "$.created_by":
+		result.SetString(string(v.Audit.CreatedBy))
+	default:
+		return fmt.Errorf("%w: %s", xpression.ErrInvalidPath, name)
+	}
+	return nil
+}
+
+// Validate checks that the expression only references fields of Order.
+func (r *OrderResolver) Validate(expression []byte) error {
+	vars, err := xpression.Variables(expression)
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		switch v.Name {
+		case "id", "@.id", "$.id",
+			"total", "@.total", "$.total",
+			"status", "@.status", "$.status",
+			"Paid", "@.Paid", "$.Paid",
+			"customer", "@.customer", "$.customer",
+			"customer.name", "@.customer.name", "$.customer.name",
+			"customer.address", "@.customer.address", "$.customer.address",
+			"customer.address.city", "@.customer.address.city", "$.customer.address.city",
+			"items", "@.items", "$.items",
+			"tags", "@.tags", "$.tags",
+			"created_by", "@.created_by", "$.created_by":
+		default:
+			return &xpression.SyntaxError{Err: xpression.ErrInvalidPath, Position: v.Pos, Token: v.Name, Source: string(expression)}
+		}
+	}
+	return nil
+}
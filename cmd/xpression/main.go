@@ -71,13 +71,13 @@ func evaluateAndPrint(str string) {
 func evalVerbose(str string) {
 	tokens, err := xpression.Parse([]byte(str))
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		printError(err)
 	} else {
 		printParsedExpression(tokens)
 
 		result, err := xpression.Evaluate(tokens, variableGetter)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
+			printError(err)
 		} else {
 			fmt.Println(result.String())
 		}
@@ -87,7 +87,7 @@ func evalVerbose(str string) {
 func evalSilent(str string) {
 	result, err := xpression.EvalVar([]byte(str), variableGetter)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		printError(err)
 	} else {
 		fmt.Println(result.String())
 	}
@@ -122,6 +122,18 @@ func variableGetter(variable []byte, result *xpression.Operand) error {
 	return nil
 }
 
+func printError(err error) {
+	var syntaxErr *xpression.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		fmt.Printf("%s\n", syntaxErr.Caret())
+	}
+	var evalErr *xpression.EvalError
+	if errors.As(err, &evalErr) && evalErr.Source != "" {
+		fmt.Printf("%s\n", evalErr.Caret())
+	}
+	fmt.Printf("Error: %v\n", err)
+}
+
 func printParsedExpression(tokens []*xpression.Token) {
 	for _, tok := range tokens {
 		fmt.Printf("%s ", tok.String())
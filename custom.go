@@ -0,0 +1,144 @@
+package xpression
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// CustomValue is implemented by domain types (money, IP addresses, versions etc.) to flow through expressions
+// as CustomOperand values. The methods define JavaScript conversions of the value: String is used
+// for concatenation with strings and regexp matching, Number for arithmetic and comparison with non-strings
+// (return NaN if the value has no numeric representation), Boolean for logical operators.
+// A custom value can also implement CustomComparer, CustomArithmetic and CustomMember.
+type CustomValue interface {
+	String() string
+	Number() float64
+	Boolean() bool
+}
+
+// CustomComparer is implemented by custom values which define equality and ordering.
+// Compare returns a negative number, zero or a positive number if the value is less than, equal to or greater
+// than other. ok is false if the values can not be compared: then all the comparisons except `!=` and `!==` are false.
+// Without CustomComparer custom values are compared by identity to each other and as primitive values
+// (see CustomValue) to other operands.
+type CustomComparer interface {
+	Compare(other *Operand) (result int, ok bool)
+}
+
+// CustomArithmetic is implemented by custom values which define arithmetic and bitwise operators.
+// op is the operator spelling: "+", "-", "*", "/", "%", "**", "&", "|", "^", "<<", ">>", "~";
+// unary minus is "-" with nil other. reversed is true if the custom value is the right operand.
+// Return false to fall back to the default behavior: the value is converted to a number
+// (or to a string if concatenated with a string).
+type CustomArithmetic interface {
+	Arithmetic(op string, other *Operand, reversed bool, result *Operand) (ok bool, err error)
+}
+
+// CustomMember is implemented by custom values which expose members to variable paths, e.g. `@.price.currency`.
+// Member returns a Go value of the member (see FromValue) or false if there is no such member.
+// Members are resolved by JSONResolver and StructResolver.
+type CustomMember interface {
+	Member(key string) (any, bool)
+}
+
+var customValueType = reflect.TypeOf((*CustomValue)(nil)).Elem()
+
+// SetCustom stores a custom value into the operand.
+func (op *Operand) SetCustom(v CustomValue) {
+	op.Type = otCustom
+	op.Object = v
+}
+
+// Custom creates an operand holding a custom value.
+func Custom(v CustomValue) *Operand {
+	return &Operand{Type: otCustom, Object: v}
+}
+
+// customMember returns a member of a custom value.
+func customMember(v CustomValue, key string) (any, bool) {
+	if m, ok := v.(CustomMember); ok {
+		return m.Member(key)
+	}
+	return nil, false
+}
+
+// doCustomArithmetic lets a custom operand execute the operator. Returns false if none of the operands did.
+func doCustomArithmetic(op Operator, left *Operand, right *Operand, result *Operand) (bool, error) {
+	spelling := operatorString(op)
+	if a, ok := left.Object.(CustomArithmetic); ok && left.Type == otCustom {
+		if done, err := a.Arithmetic(spelling, right, false, result); done || err != nil {
+			return done, err
+		}
+	}
+	if right != nil && right.Type == otCustom {
+		if a, ok := right.Object.(CustomArithmetic); ok {
+			return a.Arithmetic(spelling, left, true, result)
+		}
+	}
+	return false, nil
+}
+
+// doCustomComparison compares operands one of which is a custom value.
+func (ev *evaluator) doCustomComparison(op Operator, left *Operand, right *Operand, result *Operand) error {
+	result.Type = otBoolean
+	cmp, ok, compared := 0, false, false
+	if c, is := left.Object.(CustomComparer); is && left.Type == otCustom {
+		cmp, ok = c.Compare(right)
+		compared = true
+	} else if c, is := right.Object.(CustomComparer); is && right.Type == otCustom {
+		cmp, ok = c.Compare(left)
+		cmp, compared = -cmp, true
+	}
+	if compared {
+		if !ok {
+			result.Bool = op == opNotEqual || op == opStrictNotEqual
+			return nil
+		}
+		return doCompareNumber(op, float64(cmp), 0, result)
+	}
+	if left.Type == otCustom && right.Type == otCustom && op != opG && op != opGE && op != opL && op != opLE {
+		same := sameCustom(left.Object, right.Object)
+		result.Bool = same == (op == opEqual || op == opStrictEqual)
+		return nil
+	}
+	// convert to primitive values: strings if compared with a string, numbers otherwise
+	lval, rval := customPrimitive(left, right), customPrimitive(right, left)
+	return ev.doComparison(op, &lval, &rval, result)
+}
+
+// customPrimitive converts a custom value to a string if the other operand is a string and to a number otherwise.
+func customPrimitive(op *Operand, other *Operand) Operand {
+	if op.Type != otCustom {
+		return *op
+	}
+	if other.Type == otString {
+		return Operand{Type: otString, Str: toString(op)}
+	}
+	return Operand{Type: otNumber, Number: toNumber(op)}
+}
+
+// sameCustom reports whether two custom values are the same value. A comparable type holding
+// incomparable values in interface fields panics on ==, such values are not the same.
+func sameCustom(a, b any) (same bool) {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb || !ta.Comparable() {
+		return false
+	}
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// customJSON returns a JSON representation of a custom value: its own if it implements json.Marshaler,
+// its string representation otherwise.
+func customJSON(v any) []byte {
+	if m, ok := v.(json.Marshaler); ok {
+		if buf, err := m.MarshalJSON(); err == nil {
+			return buf
+		}
+	}
+	return quoteString([]byte(v.(CustomValue).String()), false)
+}
@@ -0,0 +1,177 @@
+package xpression
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Diagnostic is an error found in the expression by ParseRecover.
+type Diagnostic struct {
+	SyntaxError
+}
+
+// ParseResult is the outcome of ParseRecover.
+type ParseResult struct {
+	Tokens      []*Token     // all tokens in the order of appearance, including malformed ones
+	Tree        []*Token     // partial tree in prefix notation (NPN) with placeholders in place of missing operands and operators
+	Diagnostics []Diagnostic // errors in the order of appearance
+}
+
+// Err returns the first diagnostic or nil if there are none.
+func (r *ParseResult) Err() error {
+	if len(r.Diagnostics) == 0 {
+		return nil
+	}
+	return &r.Diagnostics[0].SyntaxError
+}
+
+// ParseRecover parses the expression without stopping at the first error.
+// It returns all the errors found along with a partial tree suitable for tooling such as
+// syntax highlighting and completion: malformed literals and missing operands are represented by
+// tcInvalid tokens, missing operators by placeholder operators, unbalanced parentheses are dropped or closed.
+// The tree is valid for evaluation only if there are no diagnostics.
+// The expression is checked against DefaultLimits, use Env.ParseRecover for other limits and environments.
+func ParseRecover(path []byte) *ParseResult {
+	return defaultEnv().ParseRecover(path)
+}
+
+// ParseRecover parses the expression in the environment without stopping at the first error,
+// checking it against the limits of the environment. See ParseRecover.
+func (e *Env) ParseRecover(path []byte) *ParseResult {
+	result := &ParseResult{}
+	limits := e.limits()
+	if limits.MaxLength > 0 && len(path) > limits.MaxLength {
+		pos := newPositionTracker(path).at(limits.MaxLength)
+		addDiagnostic(&result.Diagnostics, &SyntaxError{Err: ErrExpressionTooLong, Position: pos})
+		return result.withSource(path)
+	}
+
+	tokens, err := lexer(e, path, limits, newNesting(path), &result.Diagnostics)
+	if err != nil {
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			addDiagnostic(&result.Diagnostics, &SyntaxError{Err: limitErr.Err, Position: limitErr.Position})
+		}
+		return result.withSource(path)
+	}
+	result.Tokens = tokens
+
+	balanced, _ := balance(tokens, &result.Diagnostics) // no error is returned in recovery mode
+	result.Tree, _ = parser(balanced)                   // balanced tokens are always parsed
+	sort.SliceStable(result.Diagnostics, func(i, j int) bool {
+		return result.Diagnostics[i].Offset < result.Diagnostics[j].Offset
+	})
+
+	return result.withSource(path)
+}
+
+func (r *ParseResult) withSource(path []byte) *ParseResult {
+	source := string(path)
+	for i := range r.Diagnostics {
+		r.Diagnostics[i].Source = source
+	}
+	return r
+}
+
+func addDiagnostic(diags *[]Diagnostic, err *SyntaxError) {
+	*diags = append(*diags, Diagnostic{SyntaxError: *err})
+}
+
+// balance checks that operands and operators alternate properly and parentheses are balanced.
+// If diags is nil the first problem found is returned as *SyntaxError.
+// Otherwise problems are reported into diags and fixed by inserting placeholders for missing operands and operators,
+// dropping unpaired closing parentheses and closing the unpaired opening ones.
+// Unrecognized (tcUnknown) tokens are skipped.
+func balance(tokens []*Token, diags *[]Diagnostic) ([]*Token, error) {
+	result := make([]*Token, 0, len(tokens))
+	unclosed := new(tokenStack)
+	expectOperand := true
+	var prev *Token
+	var firstErr *SyntaxError
+
+	report := func(err *SyntaxError) {
+		if diags != nil {
+			addDiagnostic(diags, err)
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	missingOperand := func(tok *Token) {
+		syntaxErr := &SyntaxError{Err: ErrExpectedOperand, Position: Position{Line: 1, Column: 1}}
+		placeholder := syntaxErr.Position
+		if prev != nil {
+			syntaxErr.Position, syntaxErr.Token, placeholder = prev.Pos, prev.String(), prev.End
+			syntaxErr.Detail = fmt.Sprintf("after '%s'", prev.String())
+		} else if tok != nil {
+			syntaxErr.Position, syntaxErr.Token, placeholder = tok.Pos, tok.String(), tok.Pos
+			syntaxErr.Detail = fmt.Sprintf("before '%s'", tok.String())
+		}
+		report(syntaxErr)
+		result = append(result, &Token{Category: tcInvalid, Pos: placeholder, End: placeholder})
+	}
+	missingOperator := func(tok *Token) {
+		detail := fmt.Sprintf("before '%s'", tok.String())
+		report(&SyntaxError{Err: ErrExpectedOperator, Position: tok.Pos, Token: tok.String(), Detail: detail})
+		result = append(result, &Token{Category: tcOperator, Operator: opInvalid, Pos: tok.Pos, End: tok.Pos})
+	}
+
+	for _, tok := range tokens {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		switch tok.Category {
+		case tcUnknown:
+			continue
+		case tcLiteral, tcVariable, tcInvalid, tcFunction, tcParameter, tcLet:
+			if !expectOperand {
+				missingOperator(tok)
+			}
+			expectOperand = false
+		case tcOperator:
+			if tok.detail().Arguments == 1 { // prefix operator
+				if !expectOperand {
+					missingOperator(tok)
+				}
+				expectOperand = true
+				break
+			}
+			if expectOperand {
+				missingOperand(tok)
+			}
+			expectOperand = true
+		case tcLeftParenthesis:
+			if !expectOperand {
+				missingOperator(tok)
+			}
+			unclosed.push(tok)
+			expectOperand = true
+		case tcRightParenthesis:
+			if unclosed.peek() == nil {
+				report(&SyntaxError{Err: ErrMismatchedParentheses, Position: tok.Pos, Token: tok.String()})
+				continue
+			}
+			if expectOperand {
+				missingOperand(tok)
+			}
+			unclosed.pop()
+			expectOperand = false
+		}
+		result = append(result, tok)
+		prev = tok
+	}
+	if expectOperand && firstErr == nil {
+		missingOperand(nil)
+	}
+	for _, tok := range unclosed.get() {
+		report(&SyntaxError{Err: ErrMismatchedParentheses, Position: tok.Pos, Token: tok.String()})
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	for tok := unclosed.pop(); tok != nil; tok = unclosed.pop() {
+		end := result[len(result)-1].End
+		result = append(result, &Token{Category: tcRightParenthesis, Operator: opRightParenthesis, Pos: end, End: end})
+	}
+	return result, nil
+}
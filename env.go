@@ -0,0 +1,311 @@
+package xpression
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OperatorFunc implements a user-registered operator. right is nil for prefix operators.
+// The result must be stored into result using one of the Set* methods.
+type OperatorFunc func(left, right, result *Operand) error
+
+// OverloadFunc overloads a built-in operator. right is nil for prefix operators.
+// Return false to fall back to the built-in implementation.
+type OverloadFunc func(left, right, result *Operand) (handled bool, err error)
+
+const (
+	// public aliases
+	LeftAssociative  = aLeft
+	RightAssociative = aRight
+)
+
+// operatorDef describes an operator spelling available in an Env
+type operatorDef struct {
+	spelling []byte
+	code     Operator
+	detail   OperatorDetail
+	fn       OperatorFunc // user-registered operator
+	overload OverloadFunc // overloaded built-in operator
+}
+
+// VariableSyntax reads a variable written in a custom syntax, e.g. `${name}` or `:name`, at the beginning of input.
+// It returns the number of bytes consumed and the name passed to resolvers, 0 if input does not start with
+// such a variable. It is called wherever an operand is expected, before the built-in tokens are tried.
+// Consuming more than len(input) bytes or returning an empty name is reported as ErrInvalidPath.
+type VariableSyntax func(input []byte) (n int, name []byte, err error)
+
+// Function implements a function registered with Env.AddFunction and called as `name(arg1, arg2, ...)`.
+// The result must be stored into result using one of the Set* methods.
+type Function func(args []*Operand, result *Operand) error
+
+// NumericMode defines how the arithmetic treats invalid results.
+type NumericMode byte
+
+const (
+	// NumericFloat follows JavaScript: invalid operations produce NaN or Infinity.
+	NumericFloat NumericMode = iota
+	// NumericStrict reports ErrDivisionByZero and ErrInvalidNumber instead of producing NaN or Infinity.
+	NumericStrict
+)
+
+// functionDef describes a function available in an Env
+type functionDef struct {
+	name  string
+	arity int // -1 for variadic functions
+	fn    Function
+}
+
+// Env is a language environment: operators, functions, a default resolver, numeric mode, limits and features
+// available to expressions. Use NewEnv to create an Env with the built-in operators and the default settings,
+// then register new operators with AddInfixOperator and AddPrefixOperator, overload the built-in ones with
+// OverloadOperator, register functions with AddFunction and adjust the exported fields.
+// Settings of one Env do not affect other Envs. An Env must not be modified while it is used,
+// otherwise it is safe for concurrent use.
+//
+// Precedence of the built-in operators: `||` 1, `&&` 2, `|` 3, `^` 4, `&` 5, `==` `!=` `===` `!==` 6,
+// `<` `<=` `>` `>=` `=~` `!~` 7, `<<` `>>` 8, `+` `-` 9, `*` `/` `%` 10, `**` 11, prefix `!` `~` `-` 12.
+// The keyword operators share the precedence of their symbolic counterparts, `xor` has precedence 1.
+type Env struct {
+	Limits         Limits         // parsing and evaluation limits, DefaultLimits by default
+	Numeric        NumericMode    // NumericFloat by default
+	Resolver       Resolver       // resolves variables when no VariableFunc is given to Eval
+	DisableRegexp  bool           // reject regexp literals
+	DisableBitwise bool           // reject bitwise operators `|` `&` `^` `~` `<<` `>>`
+	RegexpFlags    string         // accepted regexp flags, "imsU" by default
+	VariableStart  string         // characters starting a variable name besides letters, "$@" by default
+	VariableSyntax VariableSyntax // reads variables in a custom syntax, nil by default
+	// KeywordOperators accepts `and`, `or`, `xor`, `not`, `matches`, `is null` and `is not null` along with
+	// the symbolic operators. The keywords are reserved: `and` is an operator, `android` is still a variable.
+	KeywordOperators bool
+
+	operators []*operatorDef // longest spelling first
+	global    bool           // the environment of the package-level functions following DefaultLimits
+	bound     []byte         // characters ending a variable name
+	functions map[string]*functionDef
+}
+
+var (
+	defaultEnvOnce sync.Once
+	defaultEnvPtr  *Env
+)
+
+// defaultEnv returns the environment used by the package-level functions.
+func defaultEnv() *Env {
+	defaultEnvOnce.Do(func() {
+		defaultEnvPtr = NewEnv()
+		defaultEnvPtr.global = true
+	})
+	return defaultEnvPtr
+}
+
+// limits returns the limits of the environment. The default environment reads DefaultLimits at call time.
+func (e *Env) limits() Limits {
+	if e.global {
+		return DefaultLimits
+	}
+	return e.Limits
+}
+
+// NewEnv creates an environment with the built-in operators and the default settings.
+func NewEnv() *Env {
+	env := &Env{Limits: DefaultLimits, RegexpFlags: "imsU", VariableStart: "$@"}
+	for _, op := range operatorSpelling {
+		env.operators = append(env.operators, &operatorDef{spelling: op.Spelling, code: op.Code, detail: operatorDetails[op.Code]})
+	}
+	env.update()
+	return env
+}
+
+// AddInfixOperator registers a binary operator. Precedence must be between 1 and 12 (see Env).
+func (e *Env) AddInfixOperator(spelling string, precedence int, associativity Associativity, fn OperatorFunc) error {
+	return e.add(spelling, OperatorDetail{Associativity: associativity, Precedence: precedence, Arguments: 2}, fn)
+}
+
+// AddPrefixOperator registers a unary prefix operator. Precedence must be between 1 and 12 (see Env).
+func (e *Env) AddPrefixOperator(spelling string, precedence int, fn OperatorFunc) error {
+	return e.add(spelling, OperatorDetail{Associativity: aRight, Precedence: precedence, Arguments: 1}, fn)
+}
+
+// OverloadOperator sets a function called before the built-in implementation of the operator.
+// For `-` the function is called for both binary and unary minus.
+// Programs compiled before the call keep the previous implementation.
+func (e *Env) OverloadOperator(spelling string, fn OverloadFunc) error {
+	found := false
+	for n, def := range e.operators {
+		if string(def.spelling) == spelling && def.fn == nil {
+			copied := *def // compiled tokens point to the previous definition
+			copied.overload = fn
+			e.operators[n] = &copied
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrUnknownOperator, spelling)
+	}
+	return nil
+}
+
+func (e *Env) add(spelling string, detail OperatorDetail, fn OperatorFunc) error {
+	if err := validOperator(spelling); err != nil {
+		return err
+	}
+	if detail.Precedence < 1 || detail.Precedence > 12 {
+		return fmt.Errorf("%w: %s: precedence %d out of range", ErrInvalidOperator, spelling, detail.Precedence)
+	}
+	if fn == nil {
+		return fmt.Errorf("%w: %s: no implementation", ErrInvalidOperator, spelling)
+	}
+	for _, def := range e.operators {
+		if string(def.spelling) == spelling && def.detail.Arguments == detail.Arguments {
+			return fmt.Errorf("%w: %s", ErrOperatorConflict, spelling)
+		}
+	}
+	if err := syntaxConflict(spelling); err != nil {
+		return err
+	}
+	e.operators = append(e.operators, &operatorDef{spelling: []byte(spelling), code: opCustom, detail: detail, fn: fn})
+	e.update()
+	return nil
+}
+
+// AddFunction registers a function called as `name(arg1, arg2, ...)` with arity arguments, -1 for any number
+// of arguments. The name must be an identifier. Once an Env has functions, a name followed by a parenthesis
+// is parsed as a call of a registered function, otherwise it is a part of a variable name as usual.
+func (e *Env) AddFunction(name string, arity int, fn Function) error {
+	if !isIdentifier(name) || fn == nil || arity < -1 {
+		return fmt.Errorf("%w: %s", ErrInvalidFunction, name)
+	}
+	if _, found := e.functions[name]; found {
+		return fmt.Errorf("%w: %s", ErrFunctionConflict, name)
+	}
+	if e.functions == nil {
+		e.functions = make(map[string]*functionDef)
+	}
+	e.functions[name] = &functionDef{name: name, arity: arity, fn: fn}
+	return nil
+}
+
+func isIdentifier(name string) bool {
+	return name != "" && identifierEnd([]byte(name), 0) == len(name)
+}
+
+// validOperator checks that the spelling can not be confused with an operand, a parenthesis or a separator.
+func validOperator(spelling string) error {
+	if spelling == "" {
+		return fmt.Errorf("%w: empty spelling", ErrInvalidOperator)
+	}
+	for i := 0; i < len(spelling); i++ {
+		c := spelling[i]
+		if isAlphanumeric(c) || c >= 0x80 || bytein(c, []byte(" \t\r\n,()[]'\"`$@.")) {
+			return fmt.Errorf("%w: %s: unexpected character %q", ErrInvalidOperator, spelling, c)
+		}
+	}
+	return nil
+}
+
+// syntaxConflict checks that the spelling is not read as something else or does not hide other syntax:
+// a comment, a regexp literal or a bind parameter.
+func syntaxConflict(spelling string) error {
+	switch {
+	case strings.Contains(spelling, "//") || strings.Contains(spelling, "/*"):
+		return fmt.Errorf("%w: %s: starts a comment", ErrOperatorConflict, spelling)
+	case spelling[0] == '/':
+		return fmt.Errorf("%w: %s: starts a regexp literal", ErrOperatorConflict, spelling)
+	case spelling[0] == '?' || spelling[0] == ':':
+		return fmt.Errorf("%w: %s: starts a bind parameter", ErrOperatorConflict, spelling)
+	}
+	return nil
+}
+
+// update sorts operators for the longest match and collects variable bounds.
+func (e *Env) update() {
+	sort.SliceStable(e.operators, func(i, j int) bool {
+		return len(e.operators[i].spelling) > len(e.operators[j].spelling)
+	})
+	e.bound = []byte{' ', '[', ','}
+	for _, def := range e.operators {
+		if !bytein(def.spelling[0], e.bound) {
+			e.bound = append(e.bound, def.spelling[0])
+		}
+	}
+}
+
+// match returns the operator spelled at the beginning of input.
+// If an infix and a prefix operator share the spelling, the prefix one is chosen when an operand is expected.
+func (e *Env) match(input []byte, expectOperand bool) *operatorDef {
+	var found *operatorDef
+	for _, def := range e.operators {
+		if found != nil && len(def.spelling) < len(found.spelling) {
+			break
+		}
+		if !matchSubslice(input, def.spelling) {
+			continue
+		}
+		if found == nil || (def.detail.Arguments == 1) == expectOperand {
+			found = def
+		}
+	}
+	return found
+}
+
+// Parse parses the expression in the environment.
+func (e *Env) Parse(expression []byte) ([]*Token, error) {
+	return parse(e, expression, e.limits())
+}
+
+// Compile parses the expression into a Program evaluated in the environment.
+func (e *Env) Compile(expression []byte) (*Program, error) {
+	tokens, err := e.Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	return newProgram(e, expression, tokens), nil
+}
+
+// Eval evaluates the expression in the environment. External variables are resolved via varFunc
+// or, if varFunc is nil, via the Resolver of the environment.
+func (e *Env) Eval(expression []byte, varFunc VariableFunc) (*Operand, error) {
+	return e.EvalContext(context.Background(), expression, varFunc)
+}
+
+// EvalContext evaluates the expression in the environment honoring ctx cancellation. See Eval.
+func (e *Env) EvalContext(ctx context.Context, expression []byte, varFunc VariableFunc) (*Operand, error) {
+	program, err := e.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	if varFunc == nil && e.Resolver != nil {
+		return program.EvalResolver(ctx, e.Resolver, e.limits())
+	}
+	return program.EvalContext(ctx, varFunc, e.limits())
+}
+
+// builtin returns the built-in operator definition with its overload, if any, for a keyword operator.
+func (e *Env) builtin(code Operator) *operatorDef {
+	for _, def := range e.operators {
+		if def.code == code && def.fn == nil && def.overload != nil {
+			return def
+		}
+	}
+	return nil
+}
+
+// isBitwise reports whether the operator is a built-in bitwise operator
+func isBitwise(op Operator) bool {
+	switch op {
+	case opBitwiseAND, opBitwiseOR, opBitwiseXOR, opBitwiseNOT, opShiftLeft, opShiftRight:
+		return true
+	}
+	return false
+}
+
+// detail returns the operator details of an operator token.
+func (tok *Token) detail() OperatorDetail {
+	if tok.def != nil {
+		return tok.def.detail
+	}
+	return operatorDetails[tok.Operator]
+}
@@ -1,21 +1,272 @@
 package xpression
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
 
 var (
-	errUnknownToken,
-	errUnexpectedEndOfString,
-	errMismatchedParentheses,
-	errNotEnoughArguments,
-	errInvalidHexadecimal,
-	errTooLongHexadecimal error
+	// syntax errors
+	ErrUnknownToken,
+	ErrUnexpectedEndOfString,
+	ErrUnterminatedComment,
+	ErrMismatchedParentheses,
+	ErrNotEnoughArguments,
+	ErrInvalidHexadecimal,
+	ErrTooLongHexadecimal,
+	ErrExpectedOperand,
+	ErrExpectedOperator error
+
+	// expression limits
+	ErrExpressionTooLong,
+	ErrNestingTooDeep,
+	ErrTooManyTokens error
+
+	// variable resolution
+	ErrInvalidPath,
+	ErrUnsupportedValue error
+
+	// evaluation resource limits
+	ErrStepLimitExceeded,
+	ErrStringTooLong,
+	ErrRegexpInputTooLong error
+
+	// value conversion
+	ErrTypeMismatch error
+
+	// environment configuration
+	ErrInvalidOperator,
+	ErrOperatorConflict,
+	ErrUnknownOperator,
+	ErrInvalidFunction,
+	ErrFunctionConflict error
+
+	// environment features
+	ErrFeatureDisabled,
+	ErrArgumentCount,
+	ErrDivisionByZero,
+	ErrInvalidNumber error
+
+	// bind parameters
+	ErrInvalidParameter,
+	ErrMixedParameters,
+	ErrUnboundParameter,
+	ErrMissingParameter,
+	ErrExtraParameter error
+
+	// expression lists
+	ErrUnexpectedComma,
+	ErrMixedList,
+	ErrDuplicateName,
+	ErrUnnamedList error
+
+	// let expressions
+	ErrInvalidBinding,
+	ErrUndefinedBinding,
+	ErrShadowedBinding,
+	ErrCyclicBinding error
 )
 
 func init() {
-	errUnknownToken = errors.New("unknown token")
-	errUnexpectedEndOfString = errors.New("unexpected end of string")
-	errMismatchedParentheses = errors.New("mismatched parentheses")
-	errNotEnoughArguments = errors.New("not enough arguments")
-	errInvalidHexadecimal = errors.New("invalid hexadecimal")
-	errTooLongHexadecimal = errors.New("too long hexadecimal")
+	ErrUnknownToken = errors.New("unknown token")
+	ErrUnexpectedEndOfString = errors.New("unexpected end of string")
+	ErrUnterminatedComment = errors.New("unterminated comment")
+	ErrMismatchedParentheses = errors.New("mismatched parentheses")
+	ErrNotEnoughArguments = errors.New("not enough arguments")
+	ErrInvalidHexadecimal = errors.New("invalid hexadecimal")
+	ErrTooLongHexadecimal = errors.New("too long hexadecimal")
+	ErrExpectedOperand = errors.New("expected operand")
+	ErrExpectedOperator = errors.New("expected operator")
+
+	ErrExpressionTooLong = errors.New("expression length limit exceeded")
+	ErrNestingTooDeep = errors.New("expression depth limit exceeded")
+	ErrTooManyTokens = errors.New("expression nodes limit exceeded")
+
+	ErrInvalidPath = errors.New("invalid variable path")
+	ErrUnsupportedValue = errors.New("unsupported value")
+
+	ErrStepLimitExceeded = errors.New("evaluation step limit exceeded")
+	ErrStringTooLong = errors.New("string too long")
+	ErrRegexpInputTooLong = errors.New("regexp input too long")
+
+	ErrTypeMismatch = errors.New("type mismatch")
+
+	ErrInvalidOperator = errors.New("invalid operator")
+	ErrOperatorConflict = errors.New("operator already defined")
+	ErrUnknownOperator = errors.New("unknown operator")
+	ErrInvalidFunction = errors.New("invalid function")
+	ErrFunctionConflict = errors.New("function already defined")
+
+	ErrFeatureDisabled = errors.New("feature disabled")
+	ErrArgumentCount = errors.New("wrong number of arguments")
+	ErrDivisionByZero = errors.New("division by zero")
+	ErrInvalidNumber = errors.New("result is not a finite number")
+
+	ErrInvalidParameter = errors.New("invalid parameter")
+	ErrMixedParameters = errors.New("positional and numbered parameters mixed")
+	ErrUnboundParameter = errors.New("parameter is not bound")
+	ErrMissingParameter = errors.New("missing parameter value")
+	ErrExtraParameter = errors.New("value has no parameter")
+
+	ErrUnexpectedComma = errors.New("unexpected comma, use EvalList for lists")
+	ErrMixedList = errors.New("named and unnamed list items mixed")
+	ErrDuplicateName = errors.New("duplicate name")
+	ErrUnnamedList = errors.New("list is not named")
+
+	ErrInvalidBinding = errors.New("invalid let binding")
+	ErrUndefinedBinding = errors.New("undefined binding")
+	ErrShadowedBinding = errors.New("binding shadows an enclosing binding")
+	ErrCyclicBinding = errors.New("cyclic binding")
+}
+
+// Position describes a location in the expression source.
+type Position struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // column number in characters (runes), starting at 1
+}
+
+// SyntaxError describes an error found while parsing an expression.
+// Use errors.Is to check the cause against one of the ErrXxx values.
+type SyntaxError struct {
+	Err error // cause
+	Position
+	Token  string // offending token
+	Source string // expression source
+	Detail string // optional context of the error, e.g. "after '+'"
+}
+
+// Error returns the cause followed by the detail or the offending token and the position of the error:
+// "expected operand after '+' at column 7", "unknown token at line 2, column 3: #".
+// The line is omitted for single-line sources.
+func (e *SyntaxError) Error() string {
+	at := fmt.Sprintf("column %d", e.Column)
+	if e.Line > 1 || strings.IndexByte(e.Source, '\n') >= 0 {
+		at = fmt.Sprintf("line %d, column %d", e.Line, e.Column)
+	}
+	switch {
+	case e.Detail != "":
+		return fmt.Sprintf("%v %s at %s", e.Err, e.Detail, at)
+	case e.Token != "":
+		return fmt.Sprintf("%v at %s: %s", e.Err, at, e.Token)
+	}
+	return fmt.Sprintf("%v at %s", e.Err, at)
+}
+
+func (e *SyntaxError) Unwrap() error { return e.Err }
+
+// Caret renders the source line containing the error with a `^` marker under the offending token.
+func (e *SyntaxError) Caret() string { return caret(e.Source, e.Position) }
+
+// EvalError describes an error occurred while evaluating an expression.
+// The position refers to the operator or variable being evaluated.
+// Use errors.Is to check the cause against one of the ErrXxx values or the error returned by VariableFunc.
+type EvalError struct {
+	Err error // cause
+	Position
+	Token  string // operator or variable being evaluated
+	Source string // expression source, empty if the expression was evaluated by Evaluate
+}
+
+func (e *EvalError) Error() string { return formatError(e.Err, e.Offset, e.Token) }
+
+func (e *EvalError) Unwrap() error { return e.Err }
+
+// Caret renders the source line containing the error with a `^` marker under the offending token.
+// Returns an empty string if the source is unknown.
+func (e *EvalError) Caret() string { return caret(e.Source, e.Position) }
+
+// LimitError is returned when an expression exceeds one of the configured Limits.
+// The cause is one of ErrExpressionTooLong, ErrNestingTooDeep or ErrTooManyTokens.
+type LimitError struct {
+	Err error // cause
+	Position
+	Max int // configured maximum
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v (%d) at %d", e.Err, e.Max, e.Offset)
+}
+
+func (e *LimitError) Unwrap() error { return e.Err }
+
+// TypeError is returned by strict conversions of an operand to a Go type and by CompileAs
+// if an expression can not produce the requested type. It wraps ErrTypeMismatch.
+type TypeError struct {
+	From  OperandType // operand type or a set of types an expression can produce
+	Value string      // operand value, empty for expressions
+	To    string      // Go type
+}
+
+func (e *TypeError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("expression yields %s, not %s", e.From, e.To)
+	}
+	return fmt.Sprintf("cannot convert %s %s to %s", e.From, e.Value, e.To)
+}
+
+func (e *TypeError) Unwrap() error { return ErrTypeMismatch }
+
+func formatError(err error, offset int, token string) string {
+	if token == "" {
+		return fmt.Sprintf("%v at %d", err, offset)
+	}
+	return fmt.Sprintf("%v at %d: %s", err, offset, token)
+}
+
+// caret returns the source line containing pos followed by a line with a `^` marker under pos.
+func caret(source string, pos Position) string {
+	if source == "" || pos.Offset > len(source) {
+		return ""
+	}
+	start := strings.LastIndexByte(source[:pos.Offset], '\n') + 1
+	end := strings.IndexByte(source[pos.Offset:], '\n')
+	if end < 0 {
+		end = len(source)
+	} else {
+		end += pos.Offset
+	}
+	line := strings.TrimRight(source[start:end], "\r")
+	var marker strings.Builder
+	for _, r := range source[start:pos.Offset] {
+		if r == '\t' {
+			marker.WriteByte('\t') // keep alignment of tab-indented lines
+		} else {
+			marker.WriteByte(' ')
+		}
+	}
+	marker.WriteByte('^')
+	return line + "\n" + marker.String()
+}
+
+// positionTracker converts byte offsets of a source into positions.
+// Offsets are expected in non-decreasing order, a smaller offset rewinds the tracker to the start of the source.
+type positionTracker struct {
+	source []byte
+	i      int // offset in source
+	pos    Position
+}
+
+func newPositionTracker(source []byte) *positionTracker {
+	return &positionTracker{source: source, pos: Position{Line: 1, Column: 1}}
+}
+
+func (t *positionTracker) at(offset int) Position {
+	if offset < t.i {
+		t.i, t.pos = 0, Position{Line: 1, Column: 1}
+	}
+	for t.i < offset && t.i < len(t.source) {
+		r, size := utf8.DecodeRune(t.source[t.i:])
+		t.i += size
+		t.pos.Offset += size
+		if r == '\n' {
+			t.pos.Line++
+			t.pos.Column = 1
+		} else {
+			t.pos.Column++
+		}
+	}
+	return t.pos
 }
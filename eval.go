@@ -1,12 +1,18 @@
 package xpression
 
+import (
+	"context"
+	"errors"
+)
+
 // Eval evaluates expression and returns the result. No external variables used. See EvalVar for more.
 func Eval(expression []byte) (*Operand, error) {
 	tokens, err := Parse(expression)
 	if err != nil {
 		return nil, err
 	}
-	return Evaluate(tokens, nil)
+	result, err := Evaluate(tokens, nil)
+	return result, withSource(err, expression)
 }
 
 // EvalStr is a wrapper for string expression.
@@ -20,10 +26,31 @@ func EvalVar(expression []byte, varFunc VariableFunc) (*Operand, error) {
 	if err != nil {
 		return nil, err
 	}
-	return Evaluate(tokens, varFunc)
+	result, err := Evaluate(tokens, varFunc)
+	return result, withSource(err, expression)
 }
 
 // EvalStrVar evaluates expression and returns the result. External variables can be used via varFunc.
 func EvalVarStr(expression string, varFunc VariableFunc) (*Operand, error) {
 	return EvalVar([]byte(expression), varFunc)
 }
+
+// EvalContext evaluates expression honoring ctx cancellation and the given limits which are applied both to
+// parsing and evaluation. External variables can be used via varFunc.
+func EvalContext(ctx context.Context, expression []byte, varFunc VariableFunc, limits Limits) (*Operand, error) {
+	tokens, err := ParseWithLimits(expression, limits)
+	if err != nil {
+		return nil, err
+	}
+	result, err := EvaluateContext(ctx, tokens, varFunc, limits)
+	return result, withSource(err, expression)
+}
+
+// withSource attaches the expression source to an evaluation error so that it can be rendered with Caret.
+func withSource(err error, expression []byte) error {
+	var evalErr *EvalError
+	if errors.As(err, &evalErr) {
+		evalErr.Source = string(expression)
+	}
+	return err
+}
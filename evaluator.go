@@ -1,14 +1,18 @@
 //
 // [1] https://tc39.es/ecma262/multipage/ecmascript-language-expressions.html used for reference of expression evaluation logic.
 //
+
 package xpression
 
 import (
 	"bytes"
+	"context"
 	"math"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -31,6 +35,7 @@ var (
 	opsLogic = []byte{
 		byte(opLogicalAND),
 		byte(opLogicalOR),
+		byte(opLogicalXOR),
 		byte(opLogicalNOT),
 	}
 
@@ -50,97 +55,217 @@ var (
 
 type VariableFunc func([]byte, *Operand) error
 
-// Evaluate evaluates the previously parsed expression
+// Evaluate evaluates the previously parsed expression using DefaultLimits.
 func Evaluate(tokens []*Token, varFunc VariableFunc) (*Operand, error) {
-	if len(tokens) == 0 {
-		return nil, errNotEnoughArguments
-	}
-	op, tokens, err := evaluate(tokens, varFunc)
+	return EvaluateContext(context.Background(), tokens, varFunc, DefaultLimits)
+}
+
+// EvaluateContext evaluates the previously parsed expression honoring ctx cancellation and the evaluation limits.
+// Errors are returned as *EvalError pointing to the operator or variable being evaluated.
+// The cause is ctx.Err() if the context is done before the evaluation is finished,
+// ErrStepLimitExceeded, ErrStringTooLong or ErrRegexpInputTooLong if the corresponding limit is exceeded.
+// The result is detached from the tokens: it can be kept and modified regardless of subsequent evaluations.
+func EvaluateContext(ctx context.Context, tokens []*Token, varFunc VariableFunc, limits Limits) (*Operand, error) {
+	result, err := EvaluateShared(ctx, tokens, varFunc, limits)
 	if err != nil {
 		return nil, err
 	}
-	if len(tokens) > 0 {
-		return nil, errNotEnoughArguments
+	return result.Clone(), nil
+}
+
+// EvaluateShared is a zero-copy variant of EvaluateContext. The result is NOT detached: it points into the tokens
+// (either a literal or a placeholder holding an intermediate result) and is overwritten by the next evaluation
+// of the same tokens. Use or Clone the result before evaluating the tokens again and never modify it.
+func EvaluateShared(ctx context.Context, tokens []*Token, varFunc VariableFunc, limits Limits) (*Operand, error) {
+	ev := evaluator{ctx: ctx, done: ctx.Done(), limits: limits}
+	if varFunc != nil {
+		ev.resolver = varFunc
 	}
-	return op, nil
+	return ev.evaluate(tokens)
 }
 
 const (
-	tokenOperand int = 0
-	tokenResult  int = 1
-	tokensRest   int = 2
+	tokenResult int = 1 // offset of the result placeholder following an operator or a variable
 )
 
+// evaluator holds the state of a single evaluation
+type evaluator struct {
+	ctx      context.Context
+	done     <-chan struct{} // ctx.Done(), nil for non-cancelable contexts
+	resolver Resolver
+	limits   Limits
+	numeric  NumericMode
+	steps    int       // number of operators executed
+	scope    *letScope // let expressions being evaluated, innermost first
+
+	// memoization: each distinct variable is resolved at most once
+	varIndex map[*Token]int // index of a distinct variable for each variable token
+	values   []Operand      // values of distinct variables
+	resolved []bool         // values[i] is resolved
+}
+
 // evaluate evaluates expression stored in `tokens` in prefix notation (NPN).
-// Usually it takes an operator from the head of the list and then takes 1 or 2 operands from the list,
-// depending of the operator type (unary or binary).
-// The edge case is when there is only one operand in the list.
-// This function calls itself recursively to evalute operands if needed.
-func evaluate(tokens []*Token, varFunc VariableFunc) (*Operand, []*Token, error) {
+// The tokens are processed from the tail to the head using an explicit operand stack:
+// literals and variables are pushed onto the stack, an operator pops 1 or 2 operands
+// (depending of the operator type) and pushes the result back.
+// This way the evaluation does not depend on the goroutine stack size no matter how long the expression is.
+// The result of an operator or a variable is stored in the placeholder token following it.
+func (ev *evaluator) evaluate(tokens []*Token) (*Operand, error) {
 	if len(tokens) == 0 {
-		return nil, nil, errNotEnoughArguments
-	}
-	tok := tokens[tokenOperand]
-	if tok.Category == tcLiteral {
-		return &tok.Operand, tokens[tokenResult:], nil
-	} else if tok.Category == tcVariable {
-		if varFunc != nil {
-			err := varFunc(tok.Str, &tokens[tokenResult].Operand)
-			return &tokens[tokenResult].Operand, tokens[tokensRest:], err
+		return nil, &EvalError{Err: ErrNotEnoughArguments}
+	}
+	var buf [16]*Operand // operand stack; short expressions do not allocate
+	stack := buf[:0]
+	for i := len(tokens) - 1; i >= 0; i-- {
+		tok := tokens[i]
+		switch tok.Category {
+		case tcLiteral:
+			stack = append(stack, &tok.Operand)
+		case tcInvalid:
+			return nil, ev.fail(tok, ErrUnknownToken)
+		case tcParameter:
+			return nil, ev.fail(tok, ErrUnboundParameter)
+		case tcVariable:
+			result := &tokens[i+tokenResult].Operand
+			if ev.values != nil {
+				n := ev.varIndex[tok]
+				result = &ev.values[n]
+				if ev.resolved[n] {
+					stack = append(stack, result)
+					continue
+				}
+				ev.resolved[n] = true
+			}
+			if ev.resolver == nil {
+				return nil, ev.fail(tok, ErrUnknownToken)
+			}
+			if err := ev.check(); err != nil {
+				return nil, ev.fail(tok, err)
+			}
+			if err := ev.resolver.Resolve(tok.Str, result); err != nil {
+				return nil, ev.fail(tok, err)
+			}
+			stack = append(stack, result)
+		case tcFunction:
+			result := &tokens[i+tokenResult].Operand
+			if err := ev.evalCall(tok, result); err != nil {
+				return nil, err
+			}
+			stack = append(stack, result)
+		case tcLet:
+			result := &tokens[i+tokenResult].Operand
+			if err := ev.evalLet(tok, result); err != nil {
+				return nil, err
+			}
+			stack = append(stack, result)
+		case tcBinding:
+			value, err := ev.binding(tok)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, value)
+		case tcOperator:
+			var left, right *Operand
+			result := &tokens[i+tokenResult].Operand
+			n := len(stack)
+			if tok.detail().Arguments > 1 {
+				if n < 2 {
+					return nil, ev.fail(tok, ErrNotEnoughArguments)
+				}
+				left, right = stack[n-1], stack[n-2]
+				stack = stack[:n-2]
+			} else {
+				if n < 1 {
+					return nil, ev.fail(tok, ErrNotEnoughArguments)
+				}
+				left = stack[n-1]
+				stack = stack[:n-1]
+			}
+			ev.steps++
+			if ev.limits.MaxSteps > 0 && ev.steps > ev.limits.MaxSteps {
+				return nil, ev.fail(tok, ErrStepLimitExceeded)
+			}
+			if err := ev.check(); err != nil {
+				return nil, ev.fail(tok, err)
+			}
+			if err := ev.execToken(tok, left, right, result); err != nil {
+				return nil, ev.fail(tok, err)
+			}
+			stack = append(stack, result)
 		}
-		return nil, tokens, errUnknownToken
 	}
+	if len(stack) != 1 {
+		return nil, ev.fail(tokens[0], ErrNotEnoughArguments)
+	}
+	return stack[0], nil
+}
 
-	var (
-		err    error
-		left   *Operand
-		right  *Operand
-		result *Operand
-	)
-	result = &tokens[tokenResult].Operand
-	left, tokens, err = evaluate(tokens[tokensRest:], varFunc)
-	if err != nil {
-		return nil, tokens, err
+// fail wraps the error occurred while evaluating tok.
+func (ev *evaluator) fail(tok *Token, err error) error {
+	return &EvalError{Err: err, Position: tok.Pos, Token: tok.String()}
+}
+
+// check returns an error if the evaluation context is canceled or its deadline is exceeded.
+func (ev *evaluator) check() error {
+	if ev.done == nil {
+		return nil
 	}
-	if operatorDetails[tok.Operator].Arguments > 1 {
-		right, tokens, err = evaluate(tokens, varFunc)
-		if err != nil {
-			return nil, tokens, err
-		}
+	select {
+	case <-ev.done:
+		return ev.ctx.Err()
+	default:
+		return nil
 	}
+}
 
-	err = execOperator(tok.Operator, left, right, result)
-	return result, tokens, err
+// execToken executes a user-registered or overloaded operator falling back to the built-in one.
+func (ev *evaluator) execToken(tok *Token, left *Operand, right *Operand, result *Operand) error {
+	if def := tok.def; def != nil {
+		if def.fn != nil {
+			return def.fn(left, right, result)
+		}
+		if handled, err := def.overload(left, right, result); handled || err != nil {
+			return err
+		}
+	}
+	return ev.execOperator(tok.Operator, left, right, result)
 }
 
 // execOperator takes an Operator and one or two Operands (the second one can be `nil` depending on operator type - unary or binary).
 // It does evaluate the expression ("operand1 operator operand2" or "operator operand1") and return Operand which is a typed value.
-func execOperator(op Operator, left *Operand, right *Operand, result *Operand) error {
+func (ev *evaluator) execOperator(op Operator, left *Operand, right *Operand, result *Operand) error {
 	if bytes.IndexByte(opsArithmetic, byte(op)) != -1 {
 		// arithmetic
-		return doArithmetic(op, left, right, result)
+		return ev.doArithmetic(op, left, right, result)
 	} else if bytes.IndexByte(opsComparison, byte(op)) != -1 {
 		// comparison
-		return doComparison(op, left, right, result)
+		return ev.doComparison(op, left, right, result)
 	} else if bytes.IndexByte(opsLogic, byte(op)) != -1 {
 		// logic
 		return doLogic(op, left, right, result)
 	}
-	return errUnknownToken
+	return ErrUnknownToken
 }
 
 // doArithmetic actually evaluates the arithmetic operators.
 // Note the special case of string concatenation: string + any_type -> string
-func doArithmetic(op Operator, left *Operand, right *Operand, result *Operand) error {
-	if op == opPlus && (left.Type|right.Type)&otString > 0 {
-		// string concatenation
+func (ev *evaluator) doArithmetic(op Operator, left *Operand, right *Operand, result *Operand) error {
+	if left.Type == otCustom || (right != nil && right.Type == otCustom) {
+		if done, err := doCustomArithmetic(op, left, right, result); done || err != nil {
+			return err
+		}
+	}
+	if op == opPlus && (left.Type|right.Type)&(otString|otObject) > 0 {
+		// string concatenation (objects are converted to strings first)
 		lval := toString(left)
 		rval := toString(right)
+		if ev.limits.MaxStringLength > 0 && len(lval)+len(rval) > ev.limits.MaxStringLength {
+			return ErrStringTooLong
+		}
 		result.Type = otString
 		result.Str = append(lval[:len(lval):len(lval)], rval...) // cannot use left buffer, must reallocate!
 		return nil
 	}
-
 	switch op {
 	case opUnaryMinus:
 		result.Number = -toNumber(left)
@@ -150,10 +275,16 @@ func doArithmetic(op Operator, left *Operand, right *Operand, result *Operand) e
 		result.Number = toNumber(left) - toNumber(right)
 	case opMultiply:
 		result.Number = toNumber(left) * toNumber(right)
-	case opDivide:
-		result.Number = toNumber(left) / toNumber(right)
-	case opRemainder:
-		result.Number = float64(int64(toNumber(left)) % int64(toNumber(right)))
+	case opDivide, opRemainder:
+		divisor := toNumber(right)
+		if divisor == 0 && ev.numeric == NumericStrict {
+			return ErrDivisionByZero
+		}
+		if op == opDivide {
+			result.Number = toNumber(left) / divisor
+		} else {
+			result.Number = math.Mod(toNumber(left), divisor)
+		}
 	case opExponentiation:
 		result.Number = math.Pow(toNumber(left), toNumber(right))
 	case opBitwiseAND:
@@ -169,20 +300,24 @@ func doArithmetic(op Operator, left *Operand, right *Operand, result *Operand) e
 	case opShiftRight:
 		result.Number = float64(int64(toNumber(left)) >> int64(toNumber(right)))
 	}
+	if ev.numeric == NumericStrict && (math.IsNaN(result.Number) || math.IsInf(result.Number, 0)) {
+		return ErrInvalidNumber
+	}
 	result.Type = otNumber
 	return nil
 }
 
 // doComaparison compares two operands. The special case is string regexp match which works only on strings.
 // Otherwise works like JS comparison.
-func doComparison(op Operator, left *Operand, right *Operand, result *Operand) error {
+func (ev *evaluator) doComparison(op Operator, left *Operand, right *Operand, result *Operand) error {
 	comparedTypes := left.Type | right.Type
 	result.Type = otBoolean
 
 	// [1] 7.2.14 (2,3)
-	if op == opEqual && comparedTypes&(otNull|otUndefined) > 0 {
+	if (op == opEqual || op == opNotEqual) && comparedTypes&(otNull|otUndefined) > 0 {
 		// at least one side is null or undefined:
-		result.Bool = (comparedTypes | otNull | otUndefined) == (otNull | otUndefined) // both are null or undefined
+		equal := (comparedTypes | otNull | otUndefined) == (otNull | otUndefined) // both are null or undefined
+		result.Bool = equal == (op == opEqual)
 		return nil
 	}
 	if op == opRegexMatch || op == opNotRegexMatch {
@@ -199,19 +334,42 @@ func doComparison(op Operator, left *Operand, right *Operand, result *Operand) e
 		// convert non-regexp part to string and compare
 		if right.Type == otRegexp {
 			lval := toString(left)
-			return doCompareRegexp(op, lval, right.Regexp, result) // regexp should be second argument
+			return ev.doCompareRegexp(op, lval, right.Regexp, result) // regexp should be second argument
 		}
 		rval := toString(right)
-		return doCompareRegexp(op, rval, left.Regexp, result) // regexp should be second argument
+		return ev.doCompareRegexp(op, rval, left.Regexp, result) // regexp should be second argument
 	}
 
 	// [1] 7.2.15 (1)
 	if (op == opStrictEqual || op == opStrictNotEqual) && left.Type != right.Type {
 		// strict comparison: types must match
-		result.Bool = false
+		result.Bool = op == opStrictNotEqual
+		return nil
+	}
+	if (op == opStrictEqual || op == opStrictNotEqual) && (comparedTypes == otNull || comparedTypes == otUndefined) {
+		result.Bool = op == opStrictEqual
+		return nil
+	}
+
+	if comparedTypes&otCustom > 0 {
+		return ev.doCustomComparison(op, left, right, result)
+	}
+
+	// [1] 7.2.15 (7), 7.2.14 (1): objects are compared by reference
+	if left.Type == otObject && right.Type == otObject && op != opG && op != opGE && op != opL && op != opLE {
+		same := sameObject(left.Object, right.Object)
+		result.Bool = same == (op == opEqual || op == opStrictEqual)
 		return nil
 	}
 
+	// [1] 7.2.14 (11,12): otherwise objects are converted to primitive values (strings),
+	// dates are converted to numbers for relational comparison
+	if comparedTypes&otObject > 0 {
+		relational := op == opG || op == opGE || op == opL || op == opLE
+		lval, rval := toPrimitive(left, relational), toPrimitive(right, relational)
+		return ev.doComparison(op, &lval, &rval, result)
+	}
+
 	// [1] 7.2.15 (4)
 	if comparedTypes == otString {
 		return doCompareString(op, toString(left), toString(right), result)
@@ -221,6 +379,17 @@ func doComparison(op Operator, left *Operand, right *Operand, result *Operand) e
 	return doCompareNumber(op, toNumber(left), toNumber(right), result)
 }
 
+// toPrimitive converts an object to a string or, for dates with a number hint, to a number. See [1] 7.1.1
+func toPrimitive(op *Operand, hintNumber bool) Operand {
+	if op.Type != otObject {
+		return *op
+	}
+	if t, ok := op.Object.(time.Time); ok && hintNumber {
+		return Operand{Type: otNumber, Number: timeToNumber(t)}
+	}
+	return Operand{Type: otString, Str: toString(op)}
+}
+
 // doLogic executes binary logical operators following JavaScript conversion rules.
 func doLogic(op Operator, left *Operand, right *Operand, result *Operand) error {
 	lval := toBoolean(left)
@@ -232,6 +401,11 @@ func doLogic(op Operator, left *Operand, right *Operand, result *Operand) error
 		*result = *right
 		return nil
 	}
+	if op == opLogicalXOR {
+		result.Type = otBoolean
+		result.Bool = lval != toBoolean(right)
+		return nil
+	}
 
 	// logical NOT
 	result.Type = otBoolean
@@ -313,7 +487,10 @@ func doCompareString(op Operator, left []byte, right []byte, result *Operand) er
 }
 
 // doCompareRegexp matches a string to regexp
-func doCompareRegexp(op Operator, left []byte, right *regexp.Regexp, result *Operand) error {
+func (ev *evaluator) doCompareRegexp(op Operator, left []byte, right *regexp.Regexp, result *Operand) error {
+	if ev.limits.MaxRegexpInput > 0 && len(left) > ev.limits.MaxRegexpInput {
+		return ErrRegexpInputTooLong
+	}
 	result.Type = otBoolean
 	if op == opRegexMatch {
 		result.Bool = right.MatchString(string(left))
@@ -341,7 +518,11 @@ func toString(op *Operand) []byte {
 			return []byte("false")
 		}
 	case otNumber:
-		return []byte(strconv.FormatFloat(op.Number, 'f', -1, 64))
+		return formatNumber(op.Number)
+	case otObject:
+		return objectToString(op.Object)
+	case otCustom:
+		return []byte(op.Object.(CustomValue).String())
 	}
 
 	return nil // not reaching here
@@ -385,6 +566,13 @@ func toNumber(op *Operand) float64 {
 		}
 	case otRegexp:
 		return math.NaN()
+	case otObject: // [1] 7.1.4 (8): object -> primitive -> number
+		if t, ok := op.Object.(time.Time); ok {
+			return timeToNumber(t)
+		}
+		return toNumber(&Operand{Type: otString, Str: objectToString(op.Object)})
+	case otCustom:
+		return op.Object.(CustomValue).Number()
 	}
 	return 0 // not reaching here
 }
@@ -402,10 +590,57 @@ func toBoolean(op *Operand) bool {
 		result = len(op.Str) > 0
 	case otNumber:
 		result = op.Number != 0 && !math.IsNaN(op.Number)
+	case otObject:
+		result = true
+	case otCustom:
+		result = op.Object.(CustomValue).Boolean()
+	}
+	return result
+}
+
+// objectToString converts object to string following JavaScript conversion rules:
+// arrays are joined with commas, time.Time is formatted as RFC 3339, other objects are converted to "[object Object]".
+func objectToString(obj any) []byte {
+	if t, ok := obj.(time.Time); ok {
+		return []byte(t.Format(time.RFC3339Nano))
+	}
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return []byte("[object Object]")
+	}
+	result := make([]byte, 0)
+	for i := 0; i < val.Len(); i++ {
+		if i > 0 {
+			result = append(result, ',')
+		}
+		var op Operand
+		if err := setReflectValue(&op, val.Index(i)); err == nil && op.Type != otNull && op.Type != otUndefined {
+			result = append(result, toString(&op)...)
+		}
 	}
 	return result
 }
 
+// sameObject reports whether two objects are the same map or slice.
+// Dates have no identity in Go, so they are equal if they denote the same instant.
+func sameObject(a, b any) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() != vb.Kind() {
+		return false
+	}
+	switch va.Kind() {
+	case reflect.Map, reflect.Pointer:
+		return va.Pointer() == vb.Pointer()
+	case reflect.Slice:
+		return va.Pointer() == vb.Pointer() && va.Len() == vb.Len()
+	}
+	return false
+}
+
 // ToBoolean is a public alias
 func ToBoolean(op *Operand) bool { return toBoolean(op) }
 
@@ -1,7 +1,15 @@
 package xpression
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_Expressions(t *testing.T) {
@@ -15,6 +23,11 @@ func Test_Expressions(t *testing.T) {
 		{` 1   `, `1`},
 		{`-1`, `-1`},
 		{`--1`, `1`},
+		{`!-1`, `false`}, // mixed prefix operators apply right to left: !(-1)
+		{`-!1`, `0`},     // -(!1)
+		{`~-1`, `0`},     // ~(-1)
+		{`-~1`, `2`},     // -(~1)
+		{`!-0 + 1`, `2`}, // (!(-0)) + 1
 		{`true`, `true`},
 		{`/abc/`, `/abc/`},
 		{`0.000`, `0`},
@@ -30,10 +43,19 @@ func Test_Expressions(t *testing.T) {
 		{`1 + - 2`, `-1`},
 		{`3 * 2`, `6`},
 		{`3 / 2`, `1.5`},
-		{`1 / 0`, `+Inf`},
-		{`-1 / 0`, `-Inf`},
+		{`-~1`, `2`},
+		{`~-1`, `0`},
+		{`!-1`, `false`},
+		{`-!0`, `-1`},
+		{`1 / 0`, `Infinity`},
+		{`-1 / 0`, `-Infinity`},
 		{`4 % 2`, `0`},
 		{`5 % 2`, `1`},
+		{`5.5 % 2`, `1.5`}, // remainder follows JavaScript, operands are not truncated to integers
+		{`-5 % 3`, `-2`},
+		{`5 % -3`, `2`},
+		{`1 % 0`, `NaN`}, // used to panic with integer division by zero
+		{`2**70 % 3`, `1`},
 		// bitwise operations
 		{`6 | 3`, `7`},
 		{`6 & 3`, `2`},
@@ -53,6 +75,9 @@ func Test_Expressions(t *testing.T) {
 		{`(2)`, `2`},
 		{`(1 + 2) * 3`, `9`},
 		{`((1 + 2))`, `3`},
+		{`(2) - 1`, `1`},
+		{`(4) / 2`, `2`},
+		{`(1) - -(1)`, `2`},
 		// comparison: numbers
 		{`1 == 2`, `false`},
 		{`1 > 2`, `false`},
@@ -80,6 +105,13 @@ func Test_Expressions(t *testing.T) {
 		{`null == true`, `false`},
 		{`null == false`, `false`},
 		{`null == null`, `true`},
+		{`null != null`, `false`},
+		{`0 != null`, `true`},
+		{`null != false`, `true`},
+		{`null != undefined`, `false`}, // [1] 7.2.14 (2,3): null and undefined are only equal to each other
+		{`undefined != null`, `false`},
+		{`undefined != 0`, `true`},
+		{`undefined != ""`, `true`},
 		// comparison: different types
 		{`"1" == 1`, `true`},
 		{`"1" == true`, `true`},
@@ -99,7 +131,15 @@ func Test_Expressions(t *testing.T) {
 		{`"a" === "a"`, `true`},
 		{`42 === 42`, `true`},
 		{`null === null`, `true`},
+		{`null !== null`, `false`},
+		{`null !== 0`, `true`},
+		{`"1" !== 1`, `true`},
 		{`false === false`, `true`},
+		{`undefined === undefined`, `true`}, // [1] 7.2.15 (2): same type null and undefined are strictly equal
+		{`undefined !== undefined`, `false`},
+		{`null !== undefined`, `true`}, // [1] 7.2.15 (1): different types are never strictly equal
+		{`1 !== "1"`, `true`},
+		{`true !== 1`, `true`},
 		// equality and non-equality
 		{`1 == null`, `false`}, // note the difference between "equality" and "less than" / "greater than" operations
 		{`0 == null`, `false`}, // when number is compared to null. This is due to different paragraphs describing
@@ -174,7 +214,7 @@ func Test_Expressions(t *testing.T) {
 			result.SetNumber(456)
 			return nil
 		}
-		return errUnknownToken
+		return ErrUnknownToken
 	}
 
 	l := len(tests)
@@ -251,7 +291,7 @@ func Test_MultipleEvaluation(t *testing.T) {
 					result.SetNumber(1)
 					return nil
 				}
-				return errUnknownToken
+				return ErrUnknownToken
 			}
 
 			tokens, err := Parse([]byte(expression))
@@ -291,7 +331,7 @@ func Test_VariableParser(t *testing.T) {
 	}
 
 	for _, pair := range testPairs {
-		_, token, err := readVar([]byte(pair.Expression), 0)
+		_, token, err := readVar([]byte(pair.Expression), 0, defaultEnv().bound)
 		if err != nil {
 			t.Errorf(pair.Expression + ": expected `" + pair.Expected + "` but got error `" + err.Error() + "`")
 		} else {
@@ -309,19 +349,31 @@ func Test_Errors(t *testing.T) {
 		Expected   string
 	}{
 		// simple arithmentic
-		{``, errNotEnoughArguments.Error()},
-		{`1 + 2 +`, errNotEnoughArguments.Error()},
-		{`2 * + 2`, errNotEnoughArguments.Error()},
-		{`1..0 +`, `strconv.ParseFloat: parsing "1..0": invalid syntax at 0: 1..0`},
-		{`"a" + "b`, errUnexpectedEndOfString.Error() + ` at 6: "b`},
-		{`"a" # "b`, errUnknownToken.Error() + ` at 4: #`},
-		{`"a" ( "b"`, errMismatchedParentheses.Error()},
-		{`"a" =~ /a(b/`, "error parsing regexp: missing closing ): `a(b` at 12: "},
-		{`?`, errUnknownToken.Error() + ` at 0: ?`},
-		{`ABC`, errUnknownToken.Error()},
-		{`0x123456789ABCDEF012345`, errTooLongHexadecimal.Error() + ` at 0: 0x123456789ABCDEF012345`},
-		{`1 + @.'foo`, errUnexpectedEndOfString.Error() + ` at 6: 'foo`},
-		{`1 + 0xABCDEFG`, errInvalidHexadecimal.Error() + ` at 4: 0xABCDEFG`},
+		{``, ErrExpectedOperand.Error() + ` at column 1`},
+		{`1 + 2 +`, `expected operand after '+' at column 7`},
+		{`2 * + 2`, `expected operand after '*' at column 3`},
+		{`1 2`, `expected operator before '2' at column 3`},
+		{`(1 + 2) (3)`, `expected operator before '(' at column 9`},
+		{`!1 !2`, `expected operator before '!' at column 4`},
+		{`1 + ()`, `expected operand after '(' at column 5`},
+		{"1 +\n  * 2", `expected operand after '+' at line 1, column 3`},
+		{"1 +\n  2 *", `expected operand after '*' at line 2, column 5`},
+		{"1 +\n  # 2", ErrUnknownToken.Error() + ` at line 2, column 3: #`},
+		{`1..0 +`, `strconv.ParseFloat: parsing "1..0": invalid syntax at column 1: 1..0`},
+		{`"a" + "b`, ErrUnexpectedEndOfString.Error() + ` at column 7: "b`},
+		{`"a" # "b`, ErrUnknownToken.Error() + ` at column 5: #`},
+		{`"a" ( "b"`, `expected operator before '(' at column 5`},
+		{`("a" + "b"`, ErrMismatchedParentheses.Error() + ` at column 1: (`},
+		{`1 + 2)`, ErrMismatchedParentheses.Error() + ` at column 6: )`},
+		{`(a + b))`, ErrMismatchedParentheses.Error() + ` at column 8: )`},
+		{`a.fn()) + 1`, ErrMismatchedParentheses.Error() + ` at column 7: )`},
+		{`"a" =~ /a(b/`, "error parsing regexp: missing closing ): `a(b` at column 8: /a(b/"},
+		{`§`, ErrUnknownToken.Error() + ` at column 1: §`},
+		{`?`, ErrUnboundParameter.Error() + ` at 0: ?`},
+		{`ABC`, ErrUnknownToken.Error() + ` at 0: ABC`},
+		{`0x123456789ABCDEF012345`, ErrTooLongHexadecimal.Error() + ` at column 1: 0x123456789ABCDEF012345`},
+		{`1 + @.'foo`, ErrUnexpectedEndOfString.Error() + ` at column 7: 'foo`},
+		{`1 + 0xABCDEFG`, ErrInvalidHexadecimal.Error() + ` at column 5: 0xABCDEFG`},
 	}
 
 	for _, tst := range tests {
@@ -349,6 +401,2012 @@ func Test_Errors(t *testing.T) {
 	}
 }
 
+func Test_ErrorPositions(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Cause      error
+		Line       int
+		Column     int
+		Token      string
+		Caret      string
+	}{
+		{"1 + # 2", ErrUnknownToken, 1, 5, `#`, "1 + # 2\n    ^"},
+		{"1 +\n  (2 * 3", ErrMismatchedParentheses, 2, 3, `(`, "  (2 * 3\n  ^"},
+		{"'цена' +\n\t'abc", ErrUnexpectedEndOfString, 2, 2, `'abc`, "\t'abc\n\t^"},
+		{"1 +\n2 +", ErrExpectedOperand, 2, 3, `+`, "2 +\n  ^"},
+		{"'a' + @.var", ErrUnknownToken, 1, 7, `@.var`, "'a' + @.var\n      ^"},
+	}
+
+	for _, tst := range tests {
+		_, err := EvalStr(tst.Expression)
+		if !errors.Is(err, tst.Cause) {
+			t.Errorf("%q: expected `%v` but got `%v`", tst.Expression, tst.Cause, err)
+			continue
+		}
+		var (
+			pos   Position
+			token string
+			caret string
+		)
+		var syntaxErr *SyntaxError
+		var evalErr *EvalError
+		if errors.As(err, &syntaxErr) {
+			pos, token, caret = syntaxErr.Position, syntaxErr.Token, syntaxErr.Caret()
+		} else if errors.As(err, &evalErr) {
+			pos, token, caret = evalErr.Position, evalErr.Token, evalErr.Caret()
+		} else {
+			t.Errorf("%q: unexpected error type %T", tst.Expression, err)
+			continue
+		}
+		if pos.Line != tst.Line || pos.Column != tst.Column {
+			t.Errorf("%q: expected %d:%d but got %d:%d", tst.Expression, tst.Line, tst.Column, pos.Line, pos.Column)
+		}
+		if token != tst.Token {
+			t.Errorf("%q: expected token `%s` but got `%s`", tst.Expression, tst.Token, token)
+		}
+		if caret != tst.Caret {
+			t.Errorf("%q: expected caret\n%s\nbut got\n%s", tst.Expression, tst.Caret, caret)
+		}
+	}
+}
+
+func Test_ParseRecover(t *testing.T) {
+
+	tests := []struct {
+		Expression  string
+		Diagnostics []string
+		Tree        string
+	}{
+		{`1 + 2`, nil, `+ IR 1 2`},
+		{`1 + 2 +`, []string{`expected operand after '+' at column 7`}, `+ IR + IR 1 2 <>`},
+		{`2 * + 2`, []string{`expected operand after '*' at column 3`}, `+ IR * IR 2 <> 2`},
+		{`1 2`, []string{`expected operator before '2' at column 3`}, `??? IR 1 2`},
+		{`(1 + 2`, []string{`mismatched parentheses at column 1: (`}, `+ IR 1 2`},
+		{`1 + 2)`, []string{`mismatched parentheses at column 6: )`}, `+ IR 1 2`},
+		{`1 + # 2, 3`, []string{
+			`unknown token at column 5: #`,
+			`unexpected comma, use EvalList for lists at column 8: ,`,
+			`expected operator before '3' at column 10`,
+		}, `??? IR + IR 1 2 3`},
+		{`0xZZ + "a" * ()`, []string{
+			`invalid hexadecimal at column 1: 0xZZ`,
+			`expected operand after '(' at column 14`,
+		}, `+ IR <0xZZ> * IR "a" <>`},
+		{`1 + 'abc`, []string{`unexpected end of string at column 5: 'abc`}, `+ IR 1 <'abc>`},
+	}
+
+	for _, tst := range tests {
+		result := ParseRecover([]byte(tst.Expression))
+		diags := make([]string, 0)
+		for _, diag := range result.Diagnostics {
+			diags = append(diags, diag.Error())
+		}
+		if strings.Join(diags, "\n") != strings.Join(tst.Diagnostics, "\n") {
+			t.Errorf("%s\n\texpected diagnostics\n%s\n\tbut got\n%s", tst.Expression, strings.Join(tst.Diagnostics, "\n"), strings.Join(diags, "\n"))
+		}
+		if (result.Err() == nil) != (len(tst.Diagnostics) == 0) {
+			t.Errorf("%s: unexpected Err() result `%v`", tst.Expression, result.Err())
+		}
+		tree := make([]string, 0)
+		for _, tok := range result.Tree {
+			str := tok.String()
+			if tok.Category == tcInvalid {
+				str = "<" + str + ">"
+			}
+			tree = append(tree, str)
+		}
+		if strings.Join(tree, " ") != tst.Tree {
+			t.Errorf("%s\n\texpected tree `%s`\n\tbut got  `%s`", tst.Expression, tst.Tree, strings.Join(tree, " "))
+		}
+	}
+
+	// limits and operators of an environment
+	env := NewEnv()
+	env.Limits.MaxLength = 8
+	if err := env.AddInfixOperator("<>", 6, LeftAssociative, func(left, right, result *Operand) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.ParseRecover([]byte(`1 <> 2`)).Err(); err != nil {
+		t.Errorf("unexpected error `%v`", err)
+	}
+	if err := env.ParseRecover([]byte(`1 + 2 + 3`)).Err(); !errors.Is(err, ErrExpressionTooLong) {
+		t.Errorf("expected `%v` but got `%v`", ErrExpressionTooLong, err)
+	}
+}
+
+func Test_Variables(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Expected   []string // name @ offset: root + structured path
+	}{
+		{`1 + 2`, []string{}},
+		{`@.a + @.b * @.a`, []string{`@.a @0: @ .a`, `@.b @6: @ .b`}},
+		{`$.a.b[2]['c d'] > 0`, []string{`$.a.b[2]['c d'] @0: $ .a .b [2] ['c d']`}},
+		{`foo.length() + @[-1][$.i+1]`, []string{`foo.length() @0:  .foo .length()`, `@[-1][$.i+1] @15: @ [-1] {$.i+1}`}},
+		{`x || (y && "a\"b" == z) || x`, []string{`x @0:  .x`, `y @6:  .y`, `z @21:  .z`}},
+	}
+
+	for _, tst := range tests {
+		refs, err := Variables([]byte(tst.Expression))
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		program, _ := Compile([]byte(tst.Expression))
+		for _, set := range [][]VarRef{refs, program.Variables()} {
+			got := make([]string, 0)
+			for _, ref := range set {
+				str := fmt.Sprintf("%s @%d: %s", ref.Name, ref.Pos.Offset, ref.Root)
+				for _, elem := range ref.Path {
+					switch elem.Kind {
+					case PathKey:
+						if strings.Contains(elem.Key, " ") {
+							str += fmt.Sprintf(" ['%s']", elem.Key)
+						} else {
+							str += " ." + elem.Key
+						}
+					case PathIndex:
+						str += fmt.Sprintf(" [%d]", elem.Index)
+					case PathExpression:
+						str += " {" + elem.Key + "}"
+					case PathCall:
+						str += " ." + elem.Key + "(" + elem.Args + ")"
+					}
+				}
+				got = append(got, str)
+			}
+			if strings.Join(got, "; ") != strings.Join(tst.Expected, "; ") {
+				t.Errorf("%s\n\texpected `%s`\n\tbut got  `%s`", tst.Expression, strings.Join(tst.Expected, "; "), strings.Join(got, "; "))
+			}
+		}
+	}
+}
+
+func Test_PartialEval(t *testing.T) {
+
+	known := map[string]*Operand{
+		"@.tenant.limit": Number(100),
+		"@.tenant.name":  String("acme"),
+		"@.tenant.vip":   Boolean(true),
+		"@.tenant.off":   Boolean(false),
+	}
+
+	tests := []struct {
+		Expression string
+		Expected   string // remaining program
+		Value      string // evaluation result with @.amount = 150
+	}{
+		{`@.tenant.limit * 2 + 1`, `201`, `201`},
+		{`@.amount > @.tenant.limit * 2`, `@.amount > 200`, `false`},
+		{`@.tenant.off && @.amount > 0`, `false`, `false`},
+		{`@.tenant.vip || @.amount > 0`, `true`, `true`},
+		{`@.tenant.vip && @.amount > 0`, `@.amount > 0`, `true`},
+		{`@.tenant.off || @.amount - 1`, `@.amount - 1`, `149`},
+		{`@.amount > 0 && @.tenant.vip`, `@.amount > 0 && true`, `true`},
+		{`@.tenant.name + "/" + @.amount`, `"acme/" + @.amount`, `"acme/150"`},
+		{`@.amount - (@.tenant.limit - 1)`, `@.amount - 99`, `51`},
+		{`(@.amount - 1) - (@.amount - @.tenant.limit)`, `@.amount - 1 - (@.amount - 100)`, `99`},
+		{`2 ** @.amount ** 0`, `2 ** @.amount ** 0`, `2`},
+		{`-(@.amount + 1) * -@.tenant.limit`, `-(@.amount + 1) * -100`, `15100`},
+	}
+
+	varFunc := func(str []byte, result *Operand) error {
+		if string(str) == "@.amount" {
+			result.SetNumber(150)
+			return nil
+		}
+		return ErrUnknownToken
+	}
+
+	for _, tst := range tests {
+		program, err := Compile([]byte(tst.Expression))
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		partial, err := PartialEval(program, known)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if partial.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + partial.String() + "`")
+		}
+		if value, ok := partial.Value(); ok && value.String() != tst.Value {
+			t.Errorf(tst.Expression + "\n\texpected value `" + tst.Value + "`\n\tbut got  `" + value.String() + "`")
+		}
+		operand, err := partial.Eval(varFunc)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Value {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Value + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+}
+
+type countingResolver struct {
+	calls   map[string]int
+	batches int
+}
+
+func (r *countingResolver) Resolve(name []byte, result *Operand) error {
+	r.calls[string(name)]++
+	result.SetNumber(float64(len(name)))
+	return nil
+}
+
+type batchResolver struct {
+	countingResolver
+}
+
+func (r *batchResolver) ResolveBatch(vars []VarRef, results []Operand) error {
+	r.batches++
+	for i, ref := range vars {
+		results[i].SetNumber(float64(len(ref.Name)))
+	}
+	return nil
+}
+
+func Test_Memoization(t *testing.T) {
+
+	expression := `@.user.score * 2 + @.user.score / @.x - (@.user.score > @.x)`
+	program, err := Compile([]byte(expression))
+	if err != nil {
+		t.Fatalf(expression + " : " + err.Error())
+	}
+
+	for n := 0; n < 2; n++ { // same program evaluated twice
+		resolver := &countingResolver{calls: make(map[string]int)}
+		result, err := program.EvalResolver(context.Background(), resolver, DefaultLimits)
+		if err != nil {
+			t.Fatalf(expression + " : " + err.Error())
+		}
+		if result.String() != "27" {
+			t.Errorf(expression + "\n\texpected `27`\n\tbut got  `" + result.String() + "`")
+		}
+		if resolver.calls["@.user.score"] != 1 || resolver.calls["@.x"] != 1 {
+			t.Errorf("expected each variable to be resolved once but got %v", resolver.calls)
+		}
+	}
+
+	batch := &batchResolver{countingResolver{calls: make(map[string]int)}}
+	result, err := program.EvalResolver(context.Background(), batch, DefaultLimits)
+	if err != nil {
+		t.Fatalf(expression + " : " + err.Error())
+	}
+	if result.String() != "27" {
+		t.Errorf(expression + "\n\texpected `27`\n\tbut got  `" + result.String() + "`")
+	}
+	if batch.batches != 1 || len(batch.calls) != 0 {
+		t.Errorf("expected a single batch call but got %d batches and %v calls", batch.batches, batch.calls)
+	}
+
+	// variables in function arguments are memoized along with the rest of the expression
+	env := NewEnv()
+	if err := env.AddFunction("max", 2, func(args []*Operand, result *Operand) error {
+		result.SetNumber(math.Max(args[0].AsFloat(), args[1].AsFloat()))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expression = `max(@.x, max(@.user.score, 1)) + @.x`
+	if program, err = env.Compile([]byte(expression)); err != nil {
+		t.Fatalf(expression + " : " + err.Error())
+	}
+	resolver := &countingResolver{calls: make(map[string]int)}
+	if result, err = program.EvalResolver(context.Background(), resolver, DefaultLimits); err != nil || result.String() != "15" {
+		t.Errorf(expression + "\n\texpected `15`\n\tbut got  `" + fmt.Sprint(result, err) + "`")
+	}
+	if resolver.calls["@.user.score"] != 1 || resolver.calls["@.x"] != 1 {
+		t.Errorf("expected each variable to be resolved once but got %v", resolver.calls)
+	}
+	batch = &batchResolver{countingResolver{calls: make(map[string]int)}}
+	if result, err = program.EvalResolver(context.Background(), batch, DefaultLimits); err != nil || result.String() != "15" {
+		t.Errorf(expression + "\n\texpected `15`\n\tbut got  `" + fmt.Sprint(result, err) + "`")
+	}
+	if batch.batches != 1 || len(batch.calls) != 0 {
+		t.Errorf("expected a single batch call but got %d batches and %v calls", batch.batches, batch.calls)
+	}
+}
+
+func Test_JSONResolver(t *testing.T) {
+
+	data := `{
+		"a": {"b": [10, 20, {"c d": "deep"}], "empty": [], "one": [5]},
+		"user": {"name": "Bob", "score": 42.5, "active": true, "tags": ["x", "y"], "nothing": null},
+		"i": 1,
+		"big": 12345678901234567890
+	}`
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`$.a.b[1]`, `20`},
+		{`$.a.b[2]['c d']`, `"deep"`},
+		{`$.a.b[-1]["c d"] + "!"`, `"deep!"`},
+		{`$.a.b[$.i + 1]['c d']`, `"deep"`},
+		{`@.user.name == "Bob" && @.user.score > 40`, `true`},
+		{`user.active`, `true`},
+		{`@.user.nothing === null`, `true`},
+		{`@.user.missing === undefined`, `true`},
+		{`@.user.missing.deeper == null`, `true`},
+		{`@.a.b[10] == null`, `true`},
+		{`@.user.tags.length + @.user.name.length()`, `5`},
+		{`@.user.tags + ""`, `"x,y"`},
+		{`@.user + ""`, `"[object Object]"`},
+		{`@.a.empty == 0`, `true`},
+		{`@.a.one * 2`, `10`},
+		{`@.user && @.user.name`, `"Bob"`},
+		{`@.user == @.user`, `true`},
+		{`@.user == @.a`, `false`},
+		{`@.user.tags`, `["x","y"]`},
+		{`$.big > 1e19`, `true`},
+	}
+
+	for _, useNumber := range []bool{false, true} {
+		var root any
+		decoder := json.NewDecoder(strings.NewReader(data))
+		if useNumber {
+			decoder.UseNumber()
+		}
+		if err := decoder.Decode(&root); err != nil {
+			t.Fatal(err)
+		}
+		resolver := NewJSONResolver(root)
+		for _, tst := range tests {
+			operand, err := EvalVar([]byte(tst.Expression), resolver.Resolve)
+			if err != nil {
+				t.Errorf(tst.Expression + " : " + err.Error())
+				continue
+			}
+			if operand.String() != tst.Expected {
+				t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+			}
+			program, _ := Compile([]byte(tst.Expression))
+			operand, err = program.EvalResolver(context.Background(), resolver, DefaultLimits)
+			if err != nil {
+				t.Errorf(tst.Expression + " : " + err.Error())
+				continue
+			}
+			if operand.String() != tst.Expected {
+				t.Errorf(tst.Expression + " (batch)\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+			}
+		}
+	}
+
+	_, err := EvalVar([]byte(`@.a.sort()`), NewJSONResolver(map[string]any{"a": []any{}}).Resolve)
+	if !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("expected `%v` but got `%v`", ErrInvalidPath, err)
+	}
+
+	// quoted keys decode escape sequences the same way string literals do
+	escaped := map[string]any{"a\nb": 1.0, "it's": 2.0, "é": 3.0}
+	for _, expression := range []string{`@['a\nb'] == 1`, `@['it\'s'] == 2`, `@["\u00e9"] == 3`, `@['a\nb'] === @["a\x0Ab"]`} {
+		if result, err := EvalVar([]byte(expression), NewJSONResolver(escaped).Resolve); err != nil || result.String() != `true` {
+			t.Errorf(expression + "\n\texpected `true`\n\tbut got  `" + fmt.Sprint(result) + "`, " + fmt.Sprint(err))
+		}
+	}
+
+	// bracketed keys are evaluated with the limits and the context of the enclosing evaluation
+	program, err := Compile([]byte(`@.a[@.i + 1 + 1]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := NewJSONResolver(map[string]any{"a": []any{1.0, 2.0, 3.0}, "i": 0.0})
+	if result, err := program.EvalResolver(context.Background(), resolver, DefaultLimits); err != nil || result.String() != `3` {
+		t.Errorf("expected `3` but got `%v`, `%v`", result, err)
+	}
+	if _, err := program.EvalResolver(context.Background(), resolver, Limits{MaxSteps: 1}); !errors.Is(err, ErrStepLimitExceeded) {
+		t.Errorf("expected `%v` but got `%v`", ErrStepLimitExceeded, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := resolver.WithContext(ctx, DefaultLimits).Resolve([]byte(`@.a[@.i]`), &Operand{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected `%v` but got `%v`", context.Canceled, err)
+	}
+}
+
+type testAddress struct {
+	City string `json:"city"`
+	Zip  string `xpr:"zip" json:"postal_code"`
+}
+
+type testAudit struct {
+	Created int
+	Name    string `json:"auditName"`
+}
+
+type testUser struct {
+	testAudit
+	Address *testAddress `json:"address"`
+	Name    string       `json:"name"`
+	Score   float64      `json:"score,omitempty"`
+	Active  bool
+	Tags    []string
+	Limits  map[string]int
+	Friends []*testUser
+	Secret  string `json:"-"`
+	age     int
+}
+
+func (u *testUser) FullName() string { return u.Name + " Smith" }
+
+func (u testUser) Fail() (int, error) { return 0, errors.New("failed") }
+
+func Test_StructResolver(t *testing.T) {
+
+	user := &testUser{
+		testAudit: testAudit{Created: 2020, Name: "audit"},
+		Address:   &testAddress{City: "Paris", Zip: "75001"},
+		Name:      "Bob",
+		Score:     42.5,
+		Active:    true,
+		Tags:      []string{"x", "y"},
+		Limits:    map[string]int{"daily": 10},
+		Friends:   []*testUser{{Name: "Alice"}, nil},
+		Secret:    "s",
+		age:       30,
+	}
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`@.name == "Bob" && @.score > 40`, `true`},
+		{`Active`, `true`},
+		{`@.address.city + " " + @.address.zip`, `"Paris 75001"`},
+		{`@.address.postal_code === undefined`, `true`},
+		{`@.Created + 1`, `2021`},
+		{`@.auditName`, `"audit"`},
+		{`@.Tags[-1] + @.Tags.length`, `"y2"`},
+		{`@.Tags + ""`, `"x,y"`},
+		{`@.Limits.daily * 2`, `20`},
+		{`@.Limits['weekly'] === undefined`, `true`},
+		{`@.Friends[0].name`, `"Alice"`},
+		{`@.Friends[1] === null`, `true`},
+		{`@.Friends[1].name == null`, `true`},
+		{`@.Secret === undefined`, `true`},
+		{`@.age === undefined`, `true`},
+		{`@.name.length()`, `3`},
+		{`$.Friends[$.Tags.length - 2].name`, `"Alice"`},
+		{`@.fullName() + "!"`, `"Bob Smith!"`},
+		{`@.Friends[0].FullName()`, `"Alice Smith"`},
+		{`@.Friends[1].FullName() == null`, `true`},
+	}
+
+	resolver := NewStructResolver(user)
+	resolver.AllowMethods = true
+	for _, tst := range tests {
+		operand, err := EvalVar([]byte(tst.Expression), resolver.Resolve)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+		program, _ := Compile([]byte(tst.Expression))
+		operand, err = program.EvalResolver(context.Background(), resolver, DefaultLimits)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + " (batch)\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	_, err := EvalVar([]byte(`@.Fail()`), resolver.Resolve)
+	if err == nil || !strings.HasPrefix(err.Error(), "failed") {
+		t.Errorf("expected `failed` but got `%v`", err)
+	}
+	_, err = EvalVar([]byte(`@.FullName()`), NewStructResolver(user).Resolve)
+	if !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("expected `%v` but got `%v`", ErrInvalidPath, err)
+	}
+}
+
+func Test_ValueConversion(t *testing.T) {
+
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		Value    any
+		Expected string
+		Type     OperandType
+	}{
+		{nil, `null`, NullOperand},
+		{true, `true`, BooleanOperand},
+		{"abc", `"abc"`, StringOperand},
+		{[]byte("abc"), `"abc"`, StringOperand},
+		{int8(-3), `-3`, NumberOperand},
+		{uint64(42), `42`, NumberOperand},
+		{float32(0.5), `0.5`, NumberOperand},
+		{json.Number("12.5"), `12.5`, NumberOperand},
+		{[]int{1, 2}, `[1,2]`, ObjectOperand},
+		{map[string]int{"a": 1}, `{"a":1}`, ObjectOperand},
+		{(*int)(nil), `null`, NullOperand},
+		{[]string(nil), `null`, NullOperand},
+		{date, `"2024-01-02T03:04:05Z"`, ObjectOperand},
+		{Number(7), `7`, NumberOperand},
+	}
+	for _, tst := range tests {
+		operand, err := FromValue(tst.Value)
+		if err != nil {
+			t.Errorf("%v : %v", tst.Value, err)
+			continue
+		}
+		if operand.Type != tst.Type || operand.String() != tst.Expected {
+			t.Errorf("%v\n\texpected %s `%s`\n\tbut got  %s `%s`", tst.Value, tst.Type, tst.Expected, operand.Type, operand.String())
+		}
+	}
+	if _, err := FromValue(make(chan int)); !errors.Is(err, ErrUnsupportedValue) {
+		t.Errorf("expected `%v` but got `%v`", ErrUnsupportedValue, err)
+	}
+
+	if v := String("x").Value(); v != "x" {
+		t.Errorf("expected `x` but got `%v`", v)
+	}
+	if v := Number(2).Value(); v != 2.0 {
+		t.Errorf("expected `2` but got `%v`", v)
+	}
+	if v := Undefined().Value(); v != nil {
+		t.Errorf("expected `nil` but got `%v`", v)
+	}
+
+	if f := String("0x10").AsFloat(); f != 16 {
+		t.Errorf("expected `16` but got `%v`", f)
+	}
+	if f := String("abc").AsFloat(); !math.IsNaN(f) {
+		t.Errorf("expected `NaN` but got `%v`", f)
+	}
+	if n := String("12.7").AsInt(); n != 12 {
+		t.Errorf("expected `12` but got `%v`", n)
+	}
+	if n := Undefined().AsInt(); n != 0 {
+		t.Errorf("expected `0` but got `%v`", n)
+	}
+	if s := Number(1.5).AsString(); s != "1.5" {
+		t.Errorf("expected `1.5` but got `%v`", s)
+	}
+	if b := String("").AsBool(); b {
+		t.Errorf("expected `false` but got `%v`", b)
+	}
+	if _, err := String("1").AsFloatStrict(); !errors.Is(err, ErrTypeMismatch) || err.Error() != `cannot convert string "1" to float64` {
+		t.Errorf("expected type mismatch but got `%v`", err)
+	}
+	if _, err := Number(1.5).AsIntStrict(); err == nil || err.Error() != `cannot convert number 1.5 to int` {
+		t.Errorf("expected type mismatch but got `%v`", err)
+	}
+	if n, err := Number(-3).AsIntStrict(); err != nil || n != -3 {
+		t.Errorf("expected `-3` but got `%v`, `%v`", n, err)
+	}
+	if _, err := Null().AsBoolStrict(); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected type mismatch but got `%v`", err)
+	}
+
+	// dates compare as numbers and concatenate as strings
+	resolver := NewStructResolver(map[string]any{"start": date, "end": date.Add(time.Hour)})
+	for expression, expected := range map[string]string{
+		`@.start < @.end`:          `true`,
+		`@.end - @.start`:          `3600000`,
+		`"at " + @.start`:          `"at 2024-01-02T03:04:05Z"`,
+		`@.start == @.start`:       `true`,
+		`@.start >= 1704164645000`: `true`,
+	} {
+		operand, err := EvalVar([]byte(expression), resolver.Resolve)
+		if err != nil {
+			t.Errorf(expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != expected {
+			t.Errorf(expression + "\n\texpected `" + expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+}
+
+func Test_TypedEval(t *testing.T) {
+
+	vars := func(name []byte, result *Operand) error {
+		switch string(name) {
+		case "n":
+			result.SetNumber(5)
+		case "s":
+			result.SetString("12")
+		default:
+			result.SetUndefined()
+		}
+		return nil
+	}
+
+	if b, err := EvalBool([]byte(`n > 3 && s == 12`), vars); err != nil || !b {
+		t.Errorf("expected `true` but got `%v`, `%v`", b, err)
+	}
+	if b, err := EvalBool([]byte(`n && missing`), vars); err != nil || b {
+		t.Errorf("expected `false` but got `%v`, `%v`", b, err)
+	}
+	if f, err := EvalFloat([]byte(`s * 2 + n`), vars); err != nil || f != 29 {
+		t.Errorf("expected `29` but got `%v`, `%v`", f, err)
+	}
+	if f, err := EvalFloat([]byte(`s + n`), vars); err != nil || f != 125 {
+		t.Errorf("expected `125` but got `%v`, `%v`", f, err)
+	}
+	if s, err := EvalString([]byte(`"n=" + n`), vars); err != nil || s != "n=5" {
+		t.Errorf("expected `n=5` but got `%v`, `%v`", s, err)
+	}
+	if n, err := EvalAs[int]([]byte(`n / 2`), vars); err != nil || n != 2 {
+		t.Errorf("expected `2` but got `%v`, `%v`", n, err)
+	}
+	// the result is converted following JavaScript rules
+	conversions := []struct {
+		Expression string
+		Eval       func([]byte) (any, error)
+		Expected   any
+	}{
+		{`1 + 2`, func(e []byte) (any, error) { return EvalString(e, vars) }, "3"},
+		{`-n`, func(e []byte) (any, error) { return EvalString(e, vars) }, "-5"},
+		{`n > 1`, func(e []byte) (any, error) { return EvalString(e, vars) }, "true"},
+		{`n * 2`, func(e []byte) (any, error) { return EvalBool(e, vars) }, true},
+		{`n - 5`, func(e []byte) (any, error) { return EvalBool(e, vars) }, false},
+		{`"a" + n`, func(e []byte) (any, error) { return EvalBool(e, vars) }, true},
+		{`n > 1`, func(e []byte) (any, error) { return EvalFloat(e, vars) }, 1.0},
+		{`n > 1 || "x"`, func(e []byte) (any, error) { return EvalFloat(e, vars) }, 1.0},
+		{`s`, func(e []byte) (any, error) { return EvalAs[int](e, vars) }, 12},
+	}
+	for _, tst := range conversions {
+		value, err := tst.Eval([]byte(tst.Expression))
+		if err != nil || value != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + fmt.Sprint(tst.Expected) + "`\n\tbut got  `" + fmt.Sprint(value, err) + "`")
+		}
+	}
+
+	program, err := CompileAs[string]([]byte(`missing || "default"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := program.Eval(vars); err != nil || s != "default" {
+		t.Errorf("expected `default` but got `%v`, `%v`", s, err)
+	}
+
+	incompatible := []struct {
+		Expression string
+		Compile    func([]byte) error
+		Expected   string
+	}{
+		{`/a+/`, func(e []byte) error { _, err := CompileAs[float64](e); return err }, "expression yields regexp, not float64"},
+		{`undefined`, func(e []byte) error { _, err := CompileAs[int](e); return err }, "expression yields undefined, not int"},
+	}
+	for _, tst := range incompatible {
+		err := tst.Compile([]byte(tst.Expression))
+		if !errors.Is(err, ErrTypeMismatch) || err.Error() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + fmt.Sprint(err) + "`")
+		}
+	}
+}
+
+func Test_Serialization(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		String     string
+		JSON       string
+		JS         string
+	}{
+		{`"say \"hi\"\n"`, `"say \"hi\"\n"`, `"say \"hi\"\n"`, `"say \"hi\"\n"`},
+		{`'back\\slash' + "\t"`, `"back\\slash\t"`, `"back\\slash\t"`, `"back\\slash\t"`},
+		{`"\x41\u0042\u{1F600}\q"`, `"AB😀q"`, `"AB😀q"`, `"AB😀q"`},
+		{`"\u2028"`, "\"\u2028\"", `"\u2028"`, `"\u2028"`}, // encoding/json escapes U+2028
+		{`"\x01"`, `"\u0001"`, `"\u0001"`, `"\u0001"`},
+		{`1 / 0`, `Infinity`, `null`, `Infinity`},
+		{`-1 / 0`, `-Infinity`, `null`, `-Infinity`},
+		{`0 / 0`, `NaN`, `null`, `NaN`},
+		{`-0`, `0`, `0`, `0`},
+		{`1.5`, `1.5`, `1.5`, `1.5`},
+		{`true`, `true`, `true`, `true`},
+		{`null`, `null`, `null`, `null`},
+		{`missing`, `undefined`, `null`, `undefined`},
+		{`/a\/b/i`, `/(?i)a\/b/`, `"/a\\/b/i"`, `/a\/b/i`},
+		{`"a" + 1 / 0`, `"aInfinity"`, `"aInfinity"`, `"aInfinity"`},
+	}
+	undefined := func(name []byte, result *Operand) error { result.SetUndefined(); return nil }
+	for _, tst := range tests {
+		operand, err := EvalVar([]byte(tst.Expression), undefined)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.String {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.String + "`\n\tbut got  `" + operand.String() + "`")
+		}
+		buf, err := json.Marshal(operand)
+		if err != nil || string(buf) != tst.JSON {
+			t.Errorf(tst.Expression + "\n\texpected JSON `" + tst.JSON + "`\n\tbut got  `" + string(buf) + "`")
+		}
+		if operand.JSString() != tst.JS {
+			t.Errorf(tst.Expression + "\n\texpected JS `" + tst.JS + "`\n\tbut got  `" + operand.JSString() + "`")
+		}
+	}
+
+	var operands []Operand
+	if err := json.Unmarshal([]byte(`["a\"b", 1.5, true, null, [1, "x"], {"k": 2}]`), &operands); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`"a\"b"`, `1.5`, `true`, `null`, `[1,"x"]`, `{"k":2}`}
+	for i, op := range operands {
+		if op.String() != expected[i] {
+			t.Errorf("expected `%s` but got `%s`", expected[i], op.String())
+		}
+	}
+}
+
+func Test_ResultOwnership(t *testing.T) {
+
+	expression := []byte(`"abc"`)
+	result, err := Eval(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expression[1] = 'X'
+	if result.String() != `"abc"` {
+		t.Errorf("result changed with the input: `%s`", result.String())
+	}
+
+	expression = []byte(`@.name + "!"`)
+	program, err := Compile(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(expression, "@.nope")
+	name := "Bob"
+	varFunc := func(_ []byte, result *Operand) error {
+		result.SetString(name)
+		return nil
+	}
+	first, err := program.Eval(varFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = "Alice"
+	second, err := program.Eval(varFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != `"Bob!"` || second.String() != `"Alice!"` {
+		t.Errorf("expected `\"Bob!\"`, `\"Alice!\"` but got `%s`, `%s`", first.String(), second.String())
+	}
+
+	// zero-copy results are overwritten by the next evaluation
+	shared, _ := program.EvalShared(context.Background(), varFunc, DefaultLimits)
+	kept := shared.Clone()
+	name = "Eve"
+	_, _ = program.EvalShared(context.Background(), varFunc, DefaultLimits)
+	if shared.String() != `"Eve!"` || kept.String() != `"Alice!"` {
+		t.Errorf("expected `\"Eve!\"`, `\"Alice!\"` but got `%s`, `%s`", shared.String(), kept.String())
+	}
+
+	clone := first.Clone()
+	clone.Str[0] = 'X'
+	if first.String() != `"Bob!"` {
+		t.Errorf("clone shares the buffer: `%s`", first.String())
+	}
+}
+
+type testMoney struct {
+	Cents    int64
+	Currency string
+}
+
+func (m testMoney) String() string {
+	return fmt.Sprintf("%d.%02d %s", m.Cents/100, m.Cents%100, m.Currency)
+}
+func (m testMoney) Number() float64 { return float64(m.Cents) / 100 }
+func (m testMoney) Boolean() bool   { return m.Cents != 0 }
+
+func (m testMoney) Compare(other *Operand) (int, bool) {
+	switch other.Type {
+	case CustomOperand:
+		o, ok := other.Object.(testMoney)
+		if !ok || o.Currency != m.Currency {
+			return 0, false
+		}
+		return int(m.Cents - o.Cents), true
+	case NumberOperand:
+		diff := m.Number() - other.Number
+		if diff < 0 {
+			return -1, true
+		} else if diff > 0 {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (m testMoney) Arithmetic(op string, other *Operand, reversed bool, result *Operand) (bool, error) {
+	if other == nil && op == "-" {
+		result.SetCustom(testMoney{-m.Cents, m.Currency})
+		return true, nil
+	}
+	if o, ok := other.Object.(testMoney); ok && other.Type == CustomOperand && (op == "+" || op == "-") {
+		if o.Currency != m.Currency {
+			return false, errors.New("currency mismatch")
+		}
+		if op == "-" {
+			o.Cents = -o.Cents
+		}
+		result.SetCustom(testMoney{m.Cents + o.Cents, m.Currency})
+		return true, nil
+	}
+	if other.Type == NumberOperand && (op == "*" || op == "/" && !reversed) {
+		factor := other.Number
+		if op == "/" {
+			factor = 1 / factor
+		}
+		result.SetCustom(testMoney{int64(math.Round(float64(m.Cents) * factor)), m.Currency})
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m testMoney) Member(key string) (any, bool) {
+	switch key {
+	case "currency":
+		return m.Currency, true
+	case "cents":
+		return m.Cents, true
+	}
+	return nil, false
+}
+
+type testVersion struct{ major, minor int }
+
+func (v *testVersion) String() string  { return fmt.Sprintf("%d.%d", v.major, v.minor) }
+func (v *testVersion) Number() float64 { return math.NaN() }
+func (v *testVersion) Boolean() bool   { return true }
+
+type testTagged struct{ tag any } // comparable type, but == panics if tag holds a slice
+
+func (v testTagged) String() string  { return fmt.Sprint(v.tag) }
+func (v testTagged) Number() float64 { return math.NaN() }
+func (v testTagged) Boolean() bool   { return true }
+
+func Test_CustomValues(t *testing.T) {
+
+	version := &testVersion{1, 2}
+	data := map[string]any{
+		"price":   testMoney{1250, "EUR"},
+		"fee":     testMoney{250, "EUR"},
+		"usd":     testMoney{100, "USD"},
+		"zero":    testMoney{0, "EUR"},
+		"version": version,
+		"same":    version,
+		"other":   &testVersion{1, 2},
+		"tags":    testTagged{[]int{1}},
+		"tags2":   testTagged{[]int{1}},
+	}
+	type order struct {
+		Price testMoney   `json:"price"`
+		Items []testMoney `json:"items"`
+	}
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`@.price + @.fee`, `"15.00 EUR"`},
+		{`@.price - @.fee * 2`, `"7.50 EUR"`},
+		{`2 * @.fee`, `"5.00 EUR"`},
+		{`-@.fee + @.price`, `"10.00 EUR"`},
+		{`@.price + 1`, `13.5`},
+		{`"total: " + @.price`, `"total: 12.50 EUR"`},
+		{`@.price > @.fee && @.price >= 12.5 && 13 > @.price`, `true`},
+		{`@.price == @.fee`, `false`},
+		{`@.price != @.usd`, `true`},
+		{`@.price < @.usd || @.price >= @.usd`, `false`},
+		{`@.price.currency + @.price.cents`, `"EUR1250"`},
+		{`@.price.missing === undefined`, `true`},
+		{`@.zero || "none"`, `"none"`},
+		{`!@.price`, `false`},
+		{`@.price =~ /EUR$/`, `true`},
+		{`@.version == @.same && @.version != @.other`, `true`},
+		{`@.version === @.same`, `true`},
+		{`@.version == "1.2" && @.version + "" === "1.2"`, `true`},
+		{`@.version > 1`, `false`},
+		{`@.tags == @.tags2 || @.tags === @.tags`, `false`}, // incomparable values are never the same
+	}
+	for _, tst := range tests {
+		operand, err := EvalVar([]byte(tst.Expression), NewJSONResolver(data).Resolve)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	_, err := EvalVar([]byte(`@.price + @.usd`), NewJSONResolver(data).Resolve)
+	if err == nil || !strings.Contains(err.Error(), "currency mismatch") {
+		t.Errorf("expected `currency mismatch` but got `%v`", err)
+	}
+
+	resolver := NewStructResolver(order{Price: testMoney{999, "USD"}, Items: []testMoney{{100, "USD"}, {200, "USD"}}})
+	for expression, expected := range map[string]string{
+		`@.price.currency`:            `"USD"`,
+		`@.items[1] + @.items[0]`:     `"3.00 USD"`,
+		`@.items[-1].cents`:           `200`,
+		`@.items + ""`:                `"1.00 USD,2.00 USD"`,
+		`@.price > @.items[0]`:        `true`,
+		`@.price.cents / 100 == 9.99`: `true`,
+	} {
+		operand, err := EvalVar([]byte(expression), resolver.Resolve)
+		if err != nil {
+			t.Errorf(expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != expected {
+			t.Errorf(expression + "\n\texpected `" + expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	operand, err := FromValue(testMoney{5, "EUR"})
+	if err != nil || operand.Type != CustomOperand || operand.AsFloat() != 0.05 || operand.JSString() != `"0.05 EUR"` {
+		t.Errorf("unexpected custom operand `%v`, `%v`", operand, err)
+	}
+}
+
+func Test_Env(t *testing.T) {
+
+	env := NewEnv()
+	approx := func(left, right, result *Operand) error {
+		result.SetBoolean(math.Abs(left.AsFloat()-right.AsFloat()) < 0.1)
+		return nil
+	}
+	spaceship := func(left, right, result *Operand) error {
+		l, r := left.AsFloat(), right.AsFloat()
+		switch {
+		case l < r:
+			result.SetNumber(-1)
+		case l > r:
+			result.SetNumber(1)
+		default:
+			result.SetNumber(0)
+		}
+		return nil
+	}
+	length := func(left, _, result *Operand) error {
+		result.SetNumber(float64(len([]rune(left.AsString()))))
+		return nil
+	}
+	repeat := func(left, right, result *Operand) (bool, error) {
+		if left.Type != StringOperand || right == nil || right.Type != NumberOperand {
+			return false, nil
+		}
+		result.SetString(strings.Repeat(left.AsString(), right.AsInt()))
+		return true, nil
+	}
+	for _, err := range []error{
+		env.AddInfixOperator("~=", 6, LeftAssociative, approx),
+		env.AddInfixOperator("<=>", 7, LeftAssociative, spaceship),
+		env.AddPrefixOperator("#", 12, length),
+		env.OverloadOperator("*", repeat),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`1 ~= 1.05`, `true`},
+		{`1 ~= 1.5 || 2 ~= 2`, `true`},
+		{`1 + 2 <=> 3`, `0`},
+		{`1 <=> 2`, `-1`},
+		{`1 <= 2 && 2 >= 1 && 1 < 2`, `true`},
+		{`#"abc" + 1`, `4`},
+		{`#("ab" + "cd")`, `4`},
+		{`"ab" * 3`, `"ababab"`},
+		{`2 * 3`, `6`},
+		{`-#"ab"`, `-2`},
+	}
+	for _, tst := range tests {
+		operand, err := env.Eval([]byte(tst.Expression), nil)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	program, err := env.Compile([]byte(`(1 + 2 <=> 3) ~= #@.a`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.String() != `1 + 2 <=> 3 ~= #@.a` {
+		t.Errorf("unexpected program `%s`", program.String())
+	}
+
+	// programs compiled before an overload keep the previous implementation
+	twice, err := env.Compile([]byte(`"ab" * 2`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.OverloadOperator("*", func(left, right, result *Operand) (bool, error) {
+		result.SetString("overloaded")
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := twice.Eval(nil); err != nil || result.String() != `"abab"` {
+		t.Errorf("expected `\"abab\"` but got `%v`, `%v`", result, err)
+	}
+	if result, err := env.Eval([]byte(`"ab" * 2`), nil); err != nil || result.String() != `"overloaded"` {
+		t.Errorf("expected `\"overloaded\"` but got `%v`, `%v`", result, err)
+	}
+
+	// other environments are not affected
+	if _, err := Eval([]byte(`1 ~= 1`)); !errors.Is(err, ErrUnknownToken) {
+		t.Errorf("expected `%v` but got `%v`", ErrUnknownToken, err)
+	}
+	if result, err := NewEnv().Eval([]byte(`"ab" * 3`), nil); err != nil || result.String() != `NaN` {
+		t.Errorf("expected `NaN` but got `%v`, `%v`", result, err)
+	}
+
+	invalid := []struct {
+		Err      error
+		Expected error
+	}{
+		{env.AddInfixOperator("==", 6, LeftAssociative, approx), ErrOperatorConflict},
+		{env.AddInfixOperator("~=", 6, LeftAssociative, approx), ErrOperatorConflict},
+		{env.AddPrefixOperator("-", 12, length), ErrOperatorConflict},
+		{env.AddInfixOperator("eq", 6, LeftAssociative, approx), ErrInvalidOperator},
+		{env.AddInfixOperator("(+", 6, LeftAssociative, approx), ErrInvalidOperator},
+		{env.AddInfixOperator("+++", 0, LeftAssociative, approx), ErrInvalidOperator},
+		{env.AddInfixOperator("+++", 9, LeftAssociative, nil), ErrInvalidOperator},
+		{env.OverloadOperator("+++", repeat), ErrUnknownOperator},
+		{env.AddInfixOperator("//", 10, LeftAssociative, approx), ErrOperatorConflict},
+		{env.AddPrefixOperator("+/*", 12, length), ErrOperatorConflict},
+		{env.AddInfixOperator("?:", 1, LeftAssociative, approx), ErrOperatorConflict},
+		{env.AddPrefixOperator("?", 12, length), ErrOperatorConflict},
+		{env.AddPrefixOperator("/", 12, length), ErrOperatorConflict},
+		{env.AddInfixOperator("/%", 10, LeftAssociative, approx), ErrOperatorConflict},
+		{env.AddPrefixOperator(":", 12, length), ErrOperatorConflict},
+		{env.AddInfixOperator(":=", 1, LeftAssociative, approx), ErrOperatorConflict},
+	}
+	for i, tst := range invalid {
+		if !errors.Is(tst.Err, tst.Expected) {
+			t.Errorf("%d: expected `%v` but got `%v`", i, tst.Expected, tst.Err)
+		}
+	}
+}
+
+func Test_EnvConfig(t *testing.T) {
+
+	env := NewEnv()
+	env.Resolver = NewJSONResolver(map[string]any{"a": 2.0, "s": "abc", "list": []any{1.0, 2.0, 3.0}})
+	sum := func(args []*Operand, result *Operand) error {
+		total := 0.0
+		for _, arg := range args {
+			total += arg.AsFloat()
+		}
+		result.SetNumber(total)
+		return nil
+	}
+	upper := func(args []*Operand, result *Operand) error {
+		result.SetString(strings.ToUpper(args[0].AsString()))
+		return nil
+	}
+	for _, err := range []error{
+		env.AddFunction("sum", -1, sum),
+		env.AddFunction("upper", 1, upper),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`sum(1, 2, 3)`, `6`},
+		{`sum()`, `0`},
+		{`sum(1 + 2, (3 * 4), sum(a, a)) * 2`, `38`},
+		{`upper(s) + upper("d,)")`, `"ABCD,)"`},
+		{`upper(@.s + ",") == "ABC,"`, `true`},
+		{`sum(@.list.length, $.a) - 1`, `4`},
+		{`1 % 0`, `NaN`},
+		{`-7.5 % 2`, `-1.5`},
+	}
+	for _, tst := range tests {
+		operand, err := env.Eval([]byte(tst.Expression), nil)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	program, err := env.Compile([]byte(`sum(@.x, (1 + 2) * 3) + upper(@.y)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.String() != `sum(@.x, (1 + 2) * 3) + upper(@.y)` {
+		t.Errorf("unexpected program `%s`", program.String())
+	}
+	if vars := program.Variables(); len(vars) != 2 || vars[0].Name != "@.x" || vars[1].Name != "@.y" {
+		t.Errorf("unexpected variables %v", vars)
+	}
+	partial, err := PartialEval(program, map[string]*Operand{"@.x": Number(1), "@.y": String("q")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial.String() != `sum(1, 9) + upper("q")` {
+		t.Errorf("unexpected program `%s`", partial.String())
+	}
+	if result, err := partial.Eval(nil); err != nil || result.String() != `"10Q"` {
+		t.Errorf("expected `\"10Q\"` but got `%v`, `%v`", result, err)
+	}
+
+	strict := NewEnv()
+	strict.Numeric = NumericStrict
+	strict.DisableRegexp = true
+	strict.DisableBitwise = true
+	strict.VariableStart = "$"
+	strict.Limits.MaxSteps = 5
+
+	errs := []struct {
+		Env        *Env
+		Expression string
+		Expected   error
+	}{
+		{strict, `1 / 0`, ErrDivisionByZero},
+		{strict, `1 % (2 - 2)`, ErrDivisionByZero},
+		{strict, `0 * "a"`, ErrInvalidNumber},
+		{strict, `"a" =~ /a/`, ErrFeatureDisabled},
+		{strict, `1 | 2`, ErrFeatureDisabled},
+		{strict, `~1`, ErrFeatureDisabled},
+		{strict, `@.a`, ErrUnknownToken},
+		{strict, `1+1+1+1+1+1+1`, ErrStepLimitExceeded},
+		{env, `upper(1, 2)`, ErrArgumentCount},
+		{env, `upper()`, ErrArgumentCount},
+		{env, `sum(1, , 2)`, ErrExpectedOperand},
+		{env, `sum(1, 2`, ErrMismatchedParentheses},
+		{env, `sum(1, 2 +)`, ErrExpectedOperand},
+		{env, `sum(1, 2) 3`, ErrExpectedOperator},
+	}
+	for _, tst := range errs {
+		_, err := tst.Env.Eval([]byte(tst.Expression), nil)
+		if !errors.Is(err, tst.Expected) {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected.Error() + "`\n\tbut got  `" + fmt.Sprint(err) + "`")
+		}
+	}
+	if result, err := strict.Eval([]byte(`7 % 2 + 1 / 4`), nil); err != nil || result.String() != `1.25` {
+		t.Errorf("expected `1.25` but got `%v`, `%v`", result, err)
+	}
+
+	// argument errors are positioned in the whole expression
+	var syntaxErr *SyntaxError
+	if _, err := env.Compile([]byte("1 +\nsum(2, 3 +)")); !errors.As(err, &syntaxErr) || syntaxErr.Line != 2 || syntaxErr.Column != 10 {
+		t.Errorf("unexpected error `%v`", err)
+	}
+
+	// a call is a nesting level like a parenthesis
+	nested := *env
+	nested.Limits = Limits{MaxDepth: 4}
+	if result, err := nested.Eval([]byte(`sum(sum(sum(sum(1))))`), nil); err != nil || result.String() != `1` {
+		t.Errorf("expected `1` but got `%v`, `%v`", result, err)
+	}
+	var limitErr *LimitError
+	for _, expr := range []string{`sum(sum(sum(sum(sum(1)))))`, `sum(1, (sum(((2)))))`, `1 + sum(2, sum(3, sum(4, sum(5, (6)))))`} {
+		if _, err := nested.Compile([]byte(expr)); !errors.As(err, &limitErr) || !errors.Is(err, ErrNestingTooDeep) {
+			t.Errorf(expr + "\n\texpected `" + ErrNestingTooDeep.Error() + "`\n\tbut got  `" + fmt.Sprint(err) + "`")
+		}
+	}
+	deep := strings.Repeat("sum(", 10000) + "1" + strings.Repeat(")", 10000)
+	if _, err := env.Compile([]byte(deep)); !errors.Is(err, ErrNestingTooDeep) {
+		t.Errorf("expected `%v` but got `%v`", ErrNestingTooDeep, err)
+	}
+	nested.Limits = Limits{MaxDepth: 20000}
+	if result, err := nested.Eval([]byte(deep), nil); err != nil || result.String() != `1` {
+		t.Errorf("expected `1` but got `%v`, `%v`", result, err)
+	}
+	nested.Limits = Limits{} // arguments are parsed recursively, so nested calls need a depth limit
+	if result, err := nested.Eval([]byte(`sum(1, ((2)))`), nil); err != nil || result.String() != `3` {
+		t.Errorf("expected `3` but got `%v`, `%v`", result, err)
+	}
+	if _, err := nested.Compile([]byte(`sum(1, sum(2))`)); !errors.Is(err, ErrNestingTooDeep) {
+		t.Errorf("expected `%v` but got `%v`", ErrNestingTooDeep, err)
+	}
+	nested.Limits = Limits{MaxDepth: 4}
+	if _, err := nested.Compile([]byte("sum(1,\n sum(sum(sum(sum(2)))))")); !errors.As(err, &limitErr) || limitErr.Position.Line != 2 || limitErr.Position.Column != 14 {
+		t.Errorf("unexpected error `%v`", err)
+	}
+
+	// functions are not available in the default environment
+	if result, err := Eval([]byte(`sum(1, 2)`)); err == nil {
+		t.Errorf("expected an error but got `%v`", result)
+	}
+
+	invalid := []struct {
+		Err      error
+		Expected error
+	}{
+		{env.AddFunction("sum", 2, sum), ErrFunctionConflict},
+		{env.AddFunction("1sum", 2, sum), ErrInvalidFunction},
+		{env.AddFunction("su-m", 2, sum), ErrInvalidFunction},
+		{env.AddFunction("total", -2, sum), ErrInvalidFunction},
+		{env.AddFunction("total", 1, nil), ErrInvalidFunction},
+	}
+	for i, tst := range invalid {
+		if !errors.Is(tst.Err, tst.Expected) {
+			t.Errorf("%d: expected `%v` but got `%v`", i, tst.Expected, tst.Err)
+		}
+	}
+}
+
+func Test_KeywordOperators(t *testing.T) {
+
+	env := NewEnv()
+	env.KeywordOperators = true
+	env.Resolver = NewJSONResolver(map[string]any{
+		"order": 5.0, "notes": "vip customer", "android": true, "island": nil, "isnull": 1.0,
+	})
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`true and false`, `false`},
+		{`false or 2`, `2`},
+		{`not false and true`, `true`},
+		{`not(1)`, `false`},
+		{`true xor false`, `true`},
+		{`1 xor "a"`, `false`},
+		{`order > 3 and notes matches /VIP/i`, `true`},
+		{`android or order`, `true`},
+		{`island is null`, `true`},
+		{`island is not null`, `false`},
+		{`@.missing is null`, `true`},
+		{`order + 1 is not  null and isnull`, `1`},
+		{`order==5&&notes!=null`, `true`},
+	}
+	for _, tst := range tests {
+		operand, err := env.Eval([]byte(tst.Expression), nil)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	program, err := env.Compile([]byte(`not @.a or @.b xor @.c is not null`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.String() != `!@.a || @.b xor @.c != null` {
+		t.Errorf("unexpected program `%s`", program.String())
+	}
+
+	// keywords are not reserved in the default environment
+	if result, err := EvalVar([]byte(`and + or`), func(name []byte, result *Operand) error {
+		result.SetString(string(name))
+		return nil
+	}); err != nil || result.String() != `"andor"` {
+		t.Errorf("expected `\"andor\"` but got `%v`, `%v`", result, err)
+	}
+	if _, err := env.Eval([]byte(`1 and`), nil); !errors.Is(err, ErrExpectedOperand) {
+		t.Errorf("expected `%v` but got `%v`", ErrExpectedOperand, err)
+	}
+}
+
+func Test_KeywordLiterals(t *testing.T) {
+
+	vars := map[string]any{
+		"trueValue": 1.0, "nullable": 2.0, "falsePositives": 3.0, "NaNs": 4.0, "true": "escaped",
+		"and": 5.0, "null": map[string]any{"length": 6.0},
+	}
+	env := NewEnv()
+	env.KeywordOperators = true
+	env.Resolver = NewJSONResolver(vars)
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`trueValue + nullable + falsePositives + NaNs`, `10`},
+		{`true && !false`, `true`},
+		{`null === null`, `true`},
+		{`undefined`, `undefined`},
+		{`undefined == null`, `true`},
+		{`NaN == NaN`, `false`},
+		{`NaN + 1`, `NaN`},
+		{`Infinity > 1e308`, `true`},
+		{`-Infinity`, `-Infinity`},
+		{`1 / Infinity`, `0`},
+		{"`true`", `"escaped"`},
+		{"`true` == true", `false`},
+		{"`and` and `and` + 1", `6`},
+		{"`null`.length", `6`},
+		{"`trueValue`", `1`},
+	}
+	for _, tst := range tests {
+		operand, err := env.Eval([]byte(tst.Expression), nil)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	program, err := env.Compile([]byte("`true` && `null`.length == Infinity || trueValue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.String() != "`true` && `null`.length == Infinity || trueValue" {
+		t.Errorf("unexpected program `%s`", program.String())
+	}
+
+	roundTrips := []struct {
+		Expression string
+		Expected   string
+	}{
+		{"`order total` + 1", "`order total` + 1"},
+		{"`a b`.c * 2", "`a b`.c * 2"},
+		{"`null`.length", "`null`.length"},
+		{"`and` and `x-y`", "`and` && `x-y`"},
+		{"`$.x y` == 1", "`$.x y` == 1"},
+		{"`1a` + `a+b`", "`1a` + `a+b`"},
+		{"`plain` + @.a", "plain + @.a"},
+	}
+	for _, tst := range roundTrips {
+		program, err := env.Compile([]byte(tst.Expression))
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if program.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + program.String() + "`")
+			continue
+		}
+		again, err := env.Compile([]byte(program.String()))
+		if err != nil {
+			t.Errorf(program.String() + " : " + err.Error())
+			continue
+		}
+		names := func(p *Program) (s []string) {
+			for _, ref := range p.Variables() {
+				s = append(s, ref.Name)
+			}
+			return s
+		}
+		if fmt.Sprint(names(again)) != fmt.Sprint(names(program)) {
+			t.Errorf(tst.Expression + "\n\texpected variables `" + fmt.Sprint(names(program)) + "`\n\tbut got  `" + fmt.Sprint(names(again)) + "`")
+		}
+	}
+
+	for _, expr := range []string{"`true", "``"} {
+		if _, err := env.Eval([]byte(expr), nil); err == nil {
+			t.Errorf(expr + " : expected an error")
+		}
+	}
+
+	// keyword operators are escaped only in an environment which reads them as operators
+	escapes := []struct {
+		Env      *Env
+		Program  string
+		Variable string
+	}{
+		{NewEnv(), "xor + 1", "xor"},
+		{env, "`xor` + 1", "`xor`"},
+	}
+	for _, tst := range escapes {
+		program, err := tst.Env.Compile([]byte("`xor` + 1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var variable string
+		for _, tok := range program.Tokens() {
+			if tok.Category == tcVariable {
+				variable = tok.String()
+			}
+		}
+		if program.String() != tst.Program || variable != tst.Variable {
+			t.Errorf("expected `%s`, `%s` but got `%s`, `%s`", tst.Program, tst.Variable, program.String(), variable)
+		}
+	}
+	if _, err := Compile([]byte(`1 xor`)); err == nil || err.Error() != "expected operator before 'xor' at column 3" {
+		t.Errorf("unexpected error `%v`", err)
+	}
+}
+
+func Test_VariableSyntax(t *testing.T) {
+
+	vars := map[string]any{"цена": 12.0, "_private": 1.0, "größe": "XL", "名前": "x", "total": 5.0, "user.name": "Ann"}
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`цена > 10`, `true`},
+		{`цена>10&&_private`, `1`},
+		{`größe + 名前`, `"XLx"`},
+		{`_private + 1`, `2`},
+	}
+	for _, tst := range tests {
+		operand, err := NewEnv().EvalContext(context.Background(), []byte(tst.Expression), func(name []byte, result *Operand) error {
+			return setJSONValue(result, vars[string(name)])
+		})
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	// `${name}` placeholders
+	env := NewEnv()
+	env.VariableSyntax = func(input []byte) (int, []byte, error) {
+		if !bytes.HasPrefix(input, []byte("${")) {
+			return 0, nil, nil
+		}
+		end := bytes.IndexByte(input, '}')
+		if end < 0 {
+			return 0, nil, ErrUnexpectedEndOfString
+		}
+		return end + 1, input[2:end], nil
+	}
+	env.Resolver = VariableFunc(func(name []byte, result *Operand) error {
+		return setJSONValue(result, vars[string(name)])
+	})
+	syntaxTests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`${total} * 2`, `10`},
+		{`${user.name} + "!"`, `"Ann!"`},
+		{`${total}-${total}`, `0`},
+		{`-${цена}`, `-12`},
+		{`$.a === null`, `true`},                   // the built-in syntax still works
+		{`let x = ${total} in x + ${total}`, `10`}, // a bare name is a binding, a placeholder is a variable
+	}
+	for _, tst := range syntaxTests {
+		operand, err := env.Eval([]byte(tst.Expression), nil)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	program, err := env.Compile([]byte(`${user.name} + (${total} - 1)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.String() != `${user.name} + (${total} - 1)` {
+		t.Errorf("unexpected program `%s`", program.String())
+	}
+	if vars := program.Variables(); len(vars) != 2 || vars[0].Name != "user.name" || vars[1].Name != "total" {
+		t.Errorf("unexpected variables %v", vars)
+	}
+	if _, err := env.Compile([]byte(`1 + ${total`)); !errors.Is(err, ErrUnexpectedEndOfString) {
+		t.Errorf("expected `%v` but got `%v`", ErrUnexpectedEndOfString, err)
+	}
+
+	// a misbehaving hook consuming past the end of input or returning an empty name
+	env.VariableSyntax = func(input []byte) (int, []byte, error) {
+		if !bytes.HasPrefix(input, []byte("${")) {
+			return 0, nil, nil
+		}
+		end := bytes.IndexByte(input, '}')
+		if end < 0 {
+			end = len(input) // no check for the closing brace
+		}
+		return end + 1, input[2:end], nil
+	}
+	for _, expr := range []string{"${a", "1 + ${total", "${}", "${} + 1"} {
+		if _, err := env.Eval([]byte(expr), nil); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf(expr+"\n\texpected `%v`\n\tbut got  `%v`", ErrInvalidPath, err)
+		}
+	}
+}
+
+func Test_Parameters(t *testing.T) {
+
+	env := NewEnv()
+	env.KeywordOperators = true
+	program, err := env.Compile([]byte(`@.amount > ? and @.currency == :cur and (? + @.fee) < 1000`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := program.Parameters()
+	if len(params) != 3 || params[0].String() != "$1" || params[1].String() != "$2" || params[2].String() != ":cur" {
+		t.Fatalf("unexpected parameters %v", params)
+	}
+	if params[2].Pos.Offset != 31 || params[1].Pos.Offset != 41 {
+		t.Errorf("unexpected positions %v", params)
+	}
+	data := map[string]any{"amount": 150.0, "currency": "USD", "fee": 2.0}
+	if _, err := program.EvalResolver(context.Background(), NewJSONResolver(data), DefaultLimits); !errors.Is(err, ErrUnboundParameter) {
+		t.Errorf("expected `%v` but got `%v`", ErrUnboundParameter, err)
+	}
+
+	bound, err := program.Bind(100, Named("cur", "USD"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound.String() != `@.amount > 100 && @.currency == "USD" && 1 + @.fee < 1000` {
+		t.Errorf("unexpected program `%s`", bound.String())
+	}
+	result, err := bound.EvalResolver(context.Background(), NewJSONResolver(data), DefaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != `true` {
+		t.Errorf("expected `true` but got `%s`", result.String())
+	}
+
+	tests := []struct {
+		Expression string
+		Args       []any
+		Expected   string
+	}{
+		{`? + ?`, []any{1, 2}, `3`},
+		{`$2 - $1 + $2`, []any{1, 5}, `9`},
+		{`:a + :b + :a`, []any{Named("b", "x"), Named("a", "y")}, `"yxy"`},
+		{`?::number * 2`, []any{21}, `42`},
+		{`:flag::boolean && $1::string`, []any{"s", Named("flag", true)}, `"s"`},
+		{`:x == null`, []any{Named("x", nil)}, `true`},
+	}
+	for _, tst := range tests {
+		program, err := Compile([]byte(tst.Expression))
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		bound, err := program.Bind(tst.Args...)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		value, ok := bound.Value()
+		if !ok {
+			t.Errorf(tst.Expression + " : not folded to a value: " + bound.String())
+			continue
+		}
+		if value.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + value.String() + "`")
+		}
+	}
+
+	if program, _ := Compile([]byte(`?::number + :n`)); program != nil {
+		if params := program.Parameters(); len(params) != 2 || params[0].Type != NumberOperand || params[1].Type != 0 {
+			t.Errorf("unexpected parameters %v", params)
+		}
+		if typ := resultType(program.tokens); typ&StringOperand == 0 {
+			t.Errorf("unexpected result type %v", typ)
+		}
+	}
+
+	errs := []struct {
+		Expression string
+		Args       []any
+		Expected   error
+	}{
+		{`? + ?`, []any{1}, ErrMissingParameter},
+		{`? + ?`, []any{1, 2, 3}, ErrExtraParameter},
+		{`:a`, []any{Named("a", 1), Named("b", 2)}, ErrExtraParameter},
+		{`:a`, []any{1}, ErrMissingParameter},
+		{`?::number`, []any{"1"}, ErrTypeMismatch},
+		{`? + $1`, nil, ErrMixedParameters},
+		{`$0`, nil, ErrInvalidParameter},
+		{`$1a`, nil, ErrInvalidParameter},
+		{`?::int`, nil, ErrInvalidParameter},
+		{`:cur.length`, nil, ErrInvalidParameter},
+	}
+	for _, tst := range errs {
+		program, err := Compile([]byte(tst.Expression))
+		if err == nil {
+			_, err = program.Bind(tst.Args...)
+		}
+		if !errors.Is(err, tst.Expected) {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected.Error() + "`\n\tbut got  `" + fmt.Sprint(err) + "`")
+		}
+	}
+
+	// `$1` is a parameter, other `$` variables are not affected; a variable named `$1` is escaped with backticks
+	vars := map[string]any{"$1": 1.0, "$1.a": 2.0, "$a": 3.0, "$.a": 4.0}
+	program, err = Compile([]byte("`$1` + `$1`.a + $a + $.a + $1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params := program.Parameters(); len(params) != 1 || params[0].String() != "$1" {
+		t.Errorf("unexpected parameters %v", params)
+	}
+	if program.String() != "`$1` + `$1`.a + $a + $.a + $1" {
+		t.Errorf("unexpected program `%s`", program.String())
+	}
+	bound, err = program.Bind(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = bound.Eval(func(name []byte, result *Operand) error {
+		return setJSONValue(result, vars[string(name)])
+	})
+	if err != nil || result.String() != `15` {
+		t.Errorf("expected `15` but got `%v`, `%v`", result, err)
+	}
+}
+
+func Test_Comments(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`1 + /* two */ 2`, `3`},
+		{`/* leading */ 6 / 2`, `3`},
+		{"6 / 2 // trailing", `3`},
+		{"6 /* a / b */ / 3", `2`},
+		{"6 //3\n / 2", `3`},
+		{`"a/*b*/c" + '//d'`, `"a/*b*/c//d"`},
+		{`"path/a" =~ /a\/*/`, `true`},
+		{"(1 + /* x */ 2) /* y */ * 3 // z,", `9`},
+		{"@.a/*x*/+1", `2`},
+	}
+	for _, tst := range tests {
+		operand, err := EvalVar([]byte(tst.Expression), func(name []byte, result *Operand) error {
+			result.SetNumber(1)
+			return nil
+		})
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + operand.String() + "`")
+		}
+	}
+
+	env := NewEnv()
+	if err := env.AddFunction("max", -1, func(args []*Operand, result *Operand) error {
+		result.SetNumber(math.Max(args[0].AsFloat(), args[1].AsFloat()))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	source := "// limits\n@.amount > 100 /* base */ &&\n/* the cap */ @.amount < max(1, /* floor, */ 2) // end"
+	program, err := env.Compile([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := program.Comments()
+	expected := []struct {
+		Text     string
+		Line     int
+		Trailing bool
+	}{
+		{"// limits", 1, false},
+		{"/* base */", 2, true},
+		{"/* the cap */", 3, false},
+		{"/* floor, */", 3, false},
+		{"// end", 3, true},
+	}
+	if len(comments) != len(expected) {
+		t.Fatalf("unexpected comments %v", comments)
+	}
+	for i, exp := range expected {
+		if comments[i].Text != exp.Text || comments[i].Pos.Line != exp.Line || comments[i].Trailing != exp.Trailing {
+			t.Errorf("%d: expected %v but got %v", i, exp, comments[i])
+		}
+	}
+	var amount *Token
+	for _, tok := range program.Tokens() {
+		if tok.Category == tcVariable && len(tok.Comments) > 0 {
+			amount = tok
+		}
+	}
+	if amount == nil || amount.Comments[0].Text != "/* the cap */" || amount.Pos.Line != 3 {
+		t.Errorf("the comment is not attached to the following token: %v", amount)
+	}
+
+	rendered := []struct {
+		Expression string
+		Expected   string
+	}{
+		{"1 // line\n + 2", "1 // line\n + 2"},
+		{"1 + /* two */ 2", "1 + /* two */ 2"},
+		{"-/* minus */1", "- /* minus */ 1"},
+		{"(1 + /* x */ 2) /* y */ * 3 // z", "(1 + /* x */ 2 /* y */) * 3 // z"},
+		{"// limits\n@.amount > 100 /* base */ &&\n/* the cap */ @.amount < 3 // end", "// limits\n@.amount > 100 /* base */ && /* the cap */ @.amount < 3 // end"},
+		{"1 /* a */ // b\n+ 2", "1 /* a */ // b\n + 2"},
+	}
+	for _, tst := range rendered {
+		program, err := Compile([]byte(tst.Expression))
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if program.String() != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + program.String() + "`")
+			continue
+		}
+		again, err := Compile([]byte(program.String()))
+		if err != nil || again.String() != program.String() || len(again.Comments()) != len(program.Comments()) {
+			t.Errorf(tst.Expression + " : the rendered program `" + program.String() + "` does not read back: " + fmt.Sprint(err))
+		}
+	}
+
+	for _, expr := range []string{"1 + /* 2", "1 /* + 2"} {
+		if _, err := Parse([]byte(expr)); !errors.Is(err, ErrUnterminatedComment) {
+			t.Errorf(expr + " : expected `" + ErrUnterminatedComment.Error() + "` but got `" + fmt.Sprint(err) + "`")
+		}
+	}
+}
+
+func Test_ExpressionLists(t *testing.T) {
+
+	varFunc := func(name []byte, result *Operand) error {
+		switch string(name) {
+		case "@.a":
+			result.SetNumber(10)
+		case "@.b":
+			result.SetNumber(5)
+		default:
+			result.SetUndefined()
+		}
+		return nil
+	}
+
+	tests := []struct {
+		Expression string
+		Expected   string
+	}{
+		{`1, 2`, `1|2`},
+		{`1`, `1`},
+		{`@.a + @.b, @.a * 0.2, "x,y"`, `15|2|"x,y"`},
+		{`(1 + 2) * 3, -1, /a,b/,`, `9|-1|/a,b/`},
+		{"1 /* , */, // 2,\n 3", `1|3`},
+		{`@.a[1,2], 4`, `undefined|4`},
+	}
+	for _, tst := range tests {
+		results, err := EvalList([]byte(tst.Expression), varFunc)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		values := make([]string, len(results))
+		for i := range results {
+			values[i] = results[i].String()
+		}
+		if strings.Join(values, "|") != tst.Expected {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`\n\tbut got  `" + strings.Join(values, "|") + "`")
+		}
+	}
+
+	named, err := EvalNamed([]byte(`total: @.a + @.b, tax: @.a * 0.2, "net amount": @.a - 1, re: /a,b/i`), varFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(named.Keys(), "|") != "total|tax|net amount|re" || named.Len() != 4 {
+		t.Errorf("unexpected keys %v", named.Keys())
+	}
+	if tax, found := named.Get("tax"); !found || tax.String() != `2` {
+		t.Errorf("unexpected tax `%v`", tax)
+	}
+	if data, err := json.Marshal(named); err != nil || string(data) != `{"total":15,"tax":2,"net amount":9,"re":"/a,b/i"}` {
+		t.Errorf("unexpected JSON `%s`, `%v`", data, err)
+	}
+
+	list, err := CompileList([]byte("a: 1 + 2,\nb: :p::number"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if programs := list.Programs(); len(programs) != 2 || programs[0].String() != `1 + 2` || programs[1].Parameters()[0].Pos.Line != 2 {
+		t.Errorf("unexpected programs %v", programs)
+	}
+
+	errs := []struct {
+		Expression string
+		Expected   error
+		Message    string
+	}{
+		{`1, 2 +`, ErrExpectedOperand, `expected operand after '+' at column 6`},
+		{`1,, 2`, ErrExpectedOperand, ``},
+		{`a: 1, 2`, ErrMixedList, `named and unnamed list items mixed at column 7: 2`},
+		{`a: 1, a: 2`, ErrDuplicateName, ``},
+		{`1 + /* 2`, ErrUnterminatedComment, ``},
+		{`(1, 2)`, ErrUnexpectedComma, ``},
+		{`a :cur, b: 1`, ErrExpectedOperator, ``}, // the colon must follow the key immediately
+		{`a: 1, b : 2`, ErrUnknownToken, ``},
+	}
+	for _, tst := range errs {
+		_, err := EvalNamed([]byte(tst.Expression), varFunc)
+		if !errors.Is(err, tst.Expected) || (tst.Message != "" && err.Error() != tst.Message) {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected.Error() + "`\n\tbut got  `" + fmt.Sprint(err) + "`")
+		}
+	}
+	if _, err := EvalNamed([]byte(`1, 2`), varFunc); !errors.Is(err, ErrUnnamedList) {
+		t.Errorf("expected `%v` but got `%v`", ErrUnnamedList, err)
+	}
+	// a single expression does not accept lists
+	if _, err := EvalVar([]byte(`@.a, -1`), varFunc); !errors.Is(err, ErrUnexpectedComma) {
+		t.Errorf("expected `%v` but got `%v`", ErrUnexpectedComma, err)
+	}
+}
+
+func Test_LetBindings(t *testing.T) {
+
+	resolved := 0
+	varFunc := func(name []byte, result *Operand) error {
+		resolved++
+		switch string(name) {
+		case "@.price":
+			result.SetNumber(10)
+		case "@.qty":
+			result.SetNumber(3)
+		case "@.discount":
+			result.SetNumber(0.5)
+		case "x":
+			result.SetNumber(5)
+		default:
+			result.SetUndefined()
+		}
+		return nil
+	}
+
+	tests := []struct {
+		Expression string
+		Expected   string
+		Resolved   int
+	}{
+		{`let subtotal = @.price * @.qty * (1 - @.discount), tax = subtotal * 0.2 in subtotal + tax`, `18`, 3},
+		{`let tax = subtotal * 0.2, subtotal = @.price * @.qty in subtotal + tax`, `36`, 2},
+		{`let x = @.price in x * x + x`, `110`, 1},
+		{`let x = @.price, unused = @.qty in x * 2`, `20`, 1},
+		{`(let a = 2 in a * a) + 1`, `5`, 0},
+		{`1 + let a = 2 in a * a`, `5`, 0},
+		{`let a = let b = 3 in b * 2, c = 1 in a + c`, `7`, 0},
+		{`let a = 1 in let b = a + 1 in a + b`, `3`, 0},
+		{`let s = "in" in s + 'x'`, `"inx"`, 0},
+		{`let letter = 1 in letter`, `1`, 0},
+		{"let a = 1, // first\n b = a /* second */ in a + b", `2`, 0},
+		{`x + (let x = 1 in x)`, `6`, 1}, // a variable out of the scope of the binding
+		{`(let x = 1 in x) + x`, `6`, 1},
+		{`(let x = 2 in x) * x + (let x = 4 in x)`, `14`, 1},
+	}
+	for _, tst := range tests {
+		resolved = 0
+		result, err := EvalVar([]byte(tst.Expression), varFunc)
+		if err != nil {
+			t.Errorf(tst.Expression + " : " + err.Error())
+			continue
+		}
+		if result.String() != tst.Expected || resolved != tst.Resolved {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected + "`, " + fmt.Sprint(tst.Resolved) + " resolved\n\tbut got  `" + result.String() + "`, " + fmt.Sprint(resolved) + " resolved")
+		}
+	}
+
+	program, err := Compile([]byte(`let total = @.price * :qty in total + @.fee`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars := program.Variables(); len(vars) != 2 || vars[0].Name != "@.price" || vars[1].Name != "@.fee" {
+		t.Errorf("unexpected variables %v", vars)
+	}
+	bound, err := program.Bind(Named("qty", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := bound.String(); s != `let total = @.price * 2 in total + @.fee` {
+		t.Errorf("unexpected bound program `%s`", s)
+	}
+	// variables in bindings and bodies are memoized along with the rest of the expression
+	expression := `let x = @.user.score * 2, y = @.x + x in @.x + x + y + @.user.score`
+	if program, err = Compile([]byte(expression)); err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingResolver{calls: make(map[string]int)}
+	if result, err := program.EvalResolver(context.Background(), counting, DefaultLimits); err != nil || result.String() != "66" {
+		t.Errorf(expression + "\n\texpected `66`\n\tbut got  `" + fmt.Sprint(result, err) + "`")
+	}
+	if counting.calls["@.user.score"] != 1 || counting.calls["@.x"] != 1 {
+		t.Errorf("expected each variable to be resolved once but got %v", counting.calls)
+	}
+	batch := &batchResolver{countingResolver{calls: make(map[string]int)}}
+	if result, err := program.EvalResolver(context.Background(), batch, DefaultLimits); err != nil || result.String() != "66" {
+		t.Errorf(expression + "\n\texpected `66`\n\tbut got  `" + fmt.Sprint(result, err) + "`")
+	}
+	if batch.batches != 1 || len(batch.calls) != 0 {
+		t.Errorf("expected a single batch call but got %d batches and %v calls", batch.batches, batch.calls)
+	}
+
+	values, err := EvalList([]byte(`let a = 1, b = 2 in a + b, 4`), varFunc)
+	if err != nil || len(values) != 2 || values[0].String() != `3` {
+		t.Errorf("unexpected list %v, %v", values, err)
+	}
+
+	errs := []struct {
+		Expression string
+		Expected   error
+		Message    string
+	}{
+		{`let a = b, b = a in a`, ErrCyclicBinding, `cyclic binding: a -> b -> a at column 5: a`},
+		{`let a = a + 1 in a`, ErrCyclicBinding, `cyclic binding: a -> a at column 5: a`},
+		{`let a = (let b = a in b) in a`, ErrCyclicBinding, ``},
+		{`let a = 1 in let a = 2 in a`, ErrShadowedBinding, `binding shadows an enclosing binding at column 18: a`},
+		{`let a = 1, a = 2 in a`, ErrDuplicateName, ``},
+		{`let a = 1 in b`, ErrUndefinedBinding, `undefined binding at column 14: b`},
+		{`let a = x in a`, ErrUndefinedBinding, ``},
+		{`(let y = x in y) + (let x = 1, y = x in y)`, ErrUndefinedBinding, ``},
+		{`let a = 1 in (let b = 2 in b) + b`, ErrUndefinedBinding, ``},
+		{`let a = 1 in`, ErrInvalidBinding, ``},
+		{`let a = 1, b`, ErrInvalidBinding, ``},
+		{`(let a = 1) + 2`, ErrInvalidBinding, ``},
+		{`let true = 1 in true`, ErrInvalidBinding, `invalid let binding at column 5: true`},
+		{`let a = 1 2 in a`, ErrExpectedOperator, `expected operator before '2' at column 11`},
+		{`let x = 2 in x, 3`, ErrUnexpectedComma, ``},
+	}
+	for _, tst := range errs {
+		_, err := EvalVar([]byte(tst.Expression), varFunc)
+		if !errors.Is(err, tst.Expected) || (tst.Message != "" && err.Error() != tst.Message) {
+			t.Errorf(tst.Expression + "\n\texpected `" + tst.Expected.Error() + "`\n\tbut got  `" + fmt.Sprint(err) + "`")
+		}
+	}
+
+	// a let expression is a nesting level like a parenthesis
+	nested := []struct {
+		Expression string
+		Expected   error
+	}{
+		{`let a = 1 in let b = 2 in let c = 3 in let d = 4 in a + b + c + d`, nil},
+		{`let a = 1 in (let b = 2 in (b + a))`, nil},
+		{`let a = 1 in let b = 2 in let c = 3 in let d = 4 in let e = 5 in e`, ErrNestingTooDeep},
+		{`let a = 1 in (let b = 2 in ((b)))`, ErrNestingTooDeep},
+		{`let a = (let b = 2 in (let c = 3 in (c))) in a`, ErrNestingTooDeep},
+	}
+	for _, tst := range nested {
+		_, err := ParseWithLimits([]byte(tst.Expression), Limits{MaxDepth: 4})
+		if !errors.Is(err, tst.Expected) {
+			t.Errorf(tst.Expression + "\n\texpected `" + fmt.Sprint(tst.Expected) + "`\n\tbut got  `" + fmt.Sprint(err) + "`")
+		}
+	}
+	var deep strings.Builder
+	for n := 0; n < 3000; n++ {
+		fmt.Fprintf(&deep, "let a%d = %d in (", n, n)
+	}
+	deep.WriteString("a0" + strings.Repeat(")", 3000))
+	if _, err := Parse([]byte(deep.String())); !errors.Is(err, ErrNestingTooDeep) {
+		t.Errorf("expected `%v` but got `%v`", ErrNestingTooDeep, err)
+	}
+	if _, err := ParseWithLimits([]byte(deep.String()), Limits{MaxDepth: 10000}); err != nil {
+		t.Errorf("unexpected error `%v`", err)
+	}
+	if _, err := ParseWithLimits([]byte(deep.String()), Limits{}); !errors.Is(err, ErrNestingTooDeep) {
+		t.Errorf("expected `%v` but got `%v`", ErrNestingTooDeep, err)
+	}
+	if _, err := ParseWithLimits([]byte(`let a = 1 in (a)`), Limits{}); err != nil {
+		t.Errorf("unexpected error `%v`", err)
+	}
+}
+
 func Test_Bugfixes(t *testing.T) {
 
 	tests := []struct {
@@ -360,6 +2418,7 @@ func Test_Bugfixes(t *testing.T) {
 		{`@.foo.length() + 1`, `124`}, // function call brackets are a part of the variable
 		{`@.var(fn()) + 2`, `125`},    // nested function calls are allowed as a part of the variable
 		{`"0x123" * 2`, `582`},        // string containing hex number is converted to number on evaluation
+		{`@.arr[1 + 1`, `123`},        // unterminated bracket ends the variable instead of panicking
 	}
 
 	varFunc := func(str []byte, result *Operand) error {
@@ -367,10 +2426,11 @@ func Test_Bugfixes(t *testing.T) {
 			"a":              123,
 			"@.foo.length()": 123,
 			"@.var(fn())":    123,
+			"@.arr[1 + 1":    123,
 		}
 		v, found := expectedVars[string(str)]
 		if !found {
-			return errUnknownToken
+			return ErrUnknownToken
 		}
 		result.SetNumber(float64(v))
 		return nil
@@ -393,6 +2453,135 @@ func Test_Bugfixes(t *testing.T) {
 	}
 }
 
+func Test_Limits(t *testing.T) {
+
+	// long and deep expressions are evaluated without recursion
+	unlimited := []struct {
+		Expression string
+		Expected   string
+	}{
+		{strings.Repeat("1+", 100000) + "1", `100001`},
+		{strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000), `1`},
+		{strings.Repeat("-(", 100000) + "1" + strings.Repeat(")", 100000), `1`},
+	}
+
+	for _, tst := range unlimited {
+		tokens, err := ParseWithLimits([]byte(tst.Expression), Limits{})
+		if err != nil {
+			t.Errorf("%.20s: %v", tst.Expression, err)
+			continue
+		}
+		operand, err := Evaluate(tokens, nil)
+		if err != nil {
+			t.Errorf("%.20s: %v", tst.Expression, err)
+			continue
+		}
+		if operand.String() != tst.Expected {
+			t.Errorf("%.20s: expected `%s` but got `%s`", tst.Expression, tst.Expected, operand.String())
+		}
+	}
+
+	tests := []struct {
+		Expression string
+		Limits     Limits
+		Expected   error
+	}{
+		{strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000), Limits{MaxDepth: 256}, ErrNestingTooDeep},
+		{`((1))`, Limits{MaxDepth: 1}, ErrNestingTooDeep},
+		{`1 + 2 + 3`, Limits{MaxLength: 8}, ErrExpressionTooLong},
+		{`1 + 2 + 3`, Limits{MaxNodes: 4}, ErrTooManyTokens},
+	}
+
+	for _, tst := range tests {
+		_, err := ParseWithLimits([]byte(tst.Expression), tst.Limits)
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%.20s: expected LimitError but got `%v`", tst.Expression, err)
+			continue
+		}
+		if !errors.Is(err, tst.Expected) {
+			t.Errorf("%.20s: expected `%v` but got `%v`", tst.Expression, tst.Expected, err)
+		}
+	}
+}
+
+func Test_EvaluationLimits(t *testing.T) {
+
+	varFunc := func(str []byte, result *Operand) error {
+		result.SetString(strings.Repeat("x", 1000))
+		return nil
+	}
+
+	tests := []struct {
+		Expression string
+		Limits     Limits
+		Expected   error
+	}{
+		{`1 + 2 + 3`, Limits{MaxSteps: 2}, nil},
+		{`1 + 2 + 3 + 4`, Limits{MaxSteps: 2}, ErrStepLimitExceeded},
+		{`-(-(-1))`, Limits{MaxSteps: 2}, ErrStepLimitExceeded},
+		{`a + a`, Limits{MaxStringLength: 2000}, nil},
+		{`a + a + "!"`, Limits{MaxStringLength: 2000}, ErrStringTooLong},
+		{`a =~ /x+/`, Limits{MaxRegexpInput: 1000}, nil},
+		{`a + 1 =~ /x+/`, Limits{MaxRegexpInput: 1000}, ErrRegexpInputTooLong},
+	}
+
+	for _, tst := range tests {
+		_, err := EvalContext(context.Background(), []byte(tst.Expression), varFunc, tst.Limits)
+		if !errors.Is(err, tst.Expected) {
+			t.Errorf("%s: expected error `%v` but got `%v`", tst.Expression, tst.Expected, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := EvalContext(ctx, []byte(`1 + 2`), nil, Limits{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error `%v` but got `%v`", context.Canceled, err)
+	}
+}
+
+func Test_DefaultLimits(t *testing.T) {
+	saved := DefaultLimits
+	defer func() { DefaultLimits = saved }()
+
+	steps := []byte(`1 + 2 + 3 + 4`)
+	long := []byte(`1 + 2 + 3 + 4 + 5 + 6`)
+	program, err := Compile(steps) // the default environment is created with the original limits
+	if err != nil {
+		t.Fatal(err)
+	}
+	typed, err := CompileAs[float64](steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := program.Eval(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	DefaultLimits = Limits{MaxSteps: 2, MaxLength: 16}
+	tests := []struct {
+		Name     string
+		Eval     func() error
+		Expected error
+	}{
+		{"EvalStr", func() error { _, err := EvalStr(string(steps)); return err }, ErrStepLimitExceeded},
+		{"Program.Eval", func() error { _, err := program.Eval(nil); return err }, ErrStepLimitExceeded},
+		{"TypedProgram.Eval", func() error { _, err := typed.Eval(nil); return err }, ErrStepLimitExceeded},
+		{"EvalList", func() error { _, err := EvalList(steps, nil); return err }, ErrStepLimitExceeded},
+		{"EvalNamed", func() error { _, err := EvalNamed([]byte(`a: 1 + 2 + 3 + 4`), nil); return err }, ErrStepLimitExceeded},
+		{"Compile", func() error { _, err := Compile(long); return err }, ErrExpressionTooLong},
+		{"CompileList", func() error { _, err := CompileList(long); return err }, ErrExpressionTooLong},
+		{"ParseRecover", func() error { return ParseRecover(long).Err() }, ErrExpressionTooLong},
+	}
+
+	for _, tst := range tests {
+		if err := tst.Eval(); !errors.Is(err, tst.Expected) {
+			t.Errorf("%s: expected error `%v` but got `%v`", tst.Name, tst.Expected, err)
+		}
+	}
+}
+
 func Benchmark_ModifiedNumericLiteral_WithParsing(b *testing.B) {
 	expression := `(2) + (2) == (4)`
 	for i := 0; i < b.N; i++ {
@@ -410,6 +2599,16 @@ func Benchmark_ModifiedNumericLiteral_WithoutParsing(b *testing.B) {
 	}
 }
 
+func Benchmark_ModifiedNumericLiteral_Shared(b *testing.B) {
+	expression := `(2) + (2) == (4)`
+	tokens, _ := Parse([]byte(expression))
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = EvaluateShared(ctx, tokens, nil, DefaultLimits)
+	}
+}
+
 func unspace(buf []byte) []byte {
 	var result []byte
 	r := 0
@@ -0,0 +1,144 @@
+package xpression
+
+import (
+	"errors"
+)
+
+// functionCall holds a registered function and its arguments parsed into separate expressions.
+type functionCall struct {
+	def  *functionDef
+	args [][]*Token
+}
+
+// callBounds holds the bounds of the arguments of a function call relative to its start.
+type callBounds struct {
+	args [][2]int
+	end  int
+}
+
+// function returns the registered function called at i: a name immediately followed by a parenthesis.
+func (e *Env) function(path []byte, i int) *functionDef {
+	if len(e.functions) == 0 {
+		return nil
+	}
+	j := identifierEnd(path, i)
+	if j == i || j == len(path) || path[j] != '(' {
+		return nil
+	}
+	return e.functions[string(path[i:j])]
+}
+
+// readCall reads a call of a registered function `name(arg1, arg2, ...)` starting at i.
+// The arguments are separated by top-level commas and parsed as separate expressions;
+// positions of their tokens and errors are relative to the whole expression located by n.
+func readCall(env *Env, path []byte, i int, def *functionDef, limits Limits, n nesting) (int, *Token, error) {
+	s := i
+	split, i, err := splitCall(env, path, i, def, n)
+	if err != nil {
+		return i, nil, err
+	}
+	bounds := split.args
+	if e, _ := skipSpaces(path, s+bounds[0][0]); len(bounds) == 1 && e >= s+bounds[0][1] {
+		bounds = bounds[:0] // `name()`
+	}
+	if def.arity >= 0 && len(bounds) != def.arity {
+		return s, nil, ErrArgumentCount
+	}
+
+	call := &functionCall{def: def, args: make([][]*Token, 0, len(bounds))}
+	for _, b := range bounds {
+		tokens, err := parseTokens(env, path[s+b[0]:s+b[1]], limits, n.part(s+b[0]))
+		if err != nil {
+			return s, nil, err
+		}
+		call.args = append(call.args, tokens)
+	}
+	return i, &Token{Category: tcFunction, Operand: Operand{Str: []byte(def.name)}, call: call}, nil
+}
+
+// splitCall splits the arguments of a call of the function starting at i. Returns the bounds of the arguments
+// relative to i and the end of the call, or the start of the call if it is not closed. The call and the nested ones are recorded in n,
+// so they are split once.
+func splitCall(env *Env, path []byte, i int, def *functionDef, n nesting) (*callBounds, int, error) {
+	if call, found := n.calls[n.offset+i]; found {
+		return call, i + call.end, nil
+	}
+	args, e, err := splitList(env, path, i+len(def.name)+1, true, n) // name and '('
+	if err != nil {
+		if errors.Is(err, ErrMismatchedParentheses) {
+			return nil, i, err
+		}
+		return nil, e, err
+	}
+	for k := range args {
+		args[k][0] -= i
+		args[k][1] -= i
+	}
+	call := &callBounds{args: args, end: e - i}
+	n.calls[n.offset+i] = call
+	return call, e, nil
+}
+
+// argumentEnd returns the position of the first comma outside of brackets and strings or the length of input.
+func argumentEnd(input []byte) int {
+	depth := 0
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\'', '"':
+			e, err := skipString(input, i)
+			if err != nil {
+				return len(input)
+			}
+			i = e - 1
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(input)
+}
+
+// subexpressions returns the separately parsed parts of a token: the arguments of a function call
+// or the binding values and the body of a let expression.
+func (tok *Token) subexpressions() [][]*Token {
+	switch {
+	case tok.call != nil:
+		return tok.call.args
+	case tok.let != nil:
+		parts := make([][]*Token, 0, len(tok.let.bindings)+1)
+		for _, b := range tok.let.bindings {
+			parts = append(parts, b.tokens)
+		}
+		return append(parts, tok.let.body)
+	}
+	return nil
+}
+
+// evalCall evaluates the arguments of a function call and calls the function.
+// Variables used in the arguments share the memoized values with the rest of the expression.
+func (ev *evaluator) evalCall(tok *Token, result *Operand) error {
+	args := make([]*Operand, len(tok.call.args))
+	for n, arg := range tok.call.args {
+		value, err := ev.evaluate(arg)
+		if err != nil {
+			return err
+		}
+		args[n] = value
+	}
+	ev.steps++
+	if ev.limits.MaxSteps > 0 && ev.steps > ev.limits.MaxSteps {
+		return ev.fail(tok, ErrStepLimitExceeded)
+	}
+	if err := ev.check(); err != nil {
+		return ev.fail(tok, err)
+	}
+	if err := tok.call.def.fn(args, result); err != nil {
+		return ev.fail(tok, err)
+	}
+	return nil
+}
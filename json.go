@@ -0,0 +1,153 @@
+package xpression
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MarshalJSON implements json.Marshaler following JSON.stringify where possible:
+// strings, finite numbers, booleans, null and objects are marshalled as is,
+// undefined, NaN and Infinity are marshalled as null, regexps are marshalled as strings `/pattern/flags`,
+// custom values are marshalled with their own MarshalJSON or as strings.
+func (op *Operand) MarshalJSON() ([]byte, error) {
+	switch op.Type {
+	case otString:
+		return quoteString(op.Str, false), nil
+	case otNumber:
+		if math.IsNaN(op.Number) || math.IsInf(op.Number, 0) {
+			return []byte("null"), nil
+		}
+		return formatNumber(op.Number), nil
+	case otBoolean:
+		return strconv.AppendBool(nil, op.Bool), nil
+	case otRegexp:
+		return quoteString([]byte(regexpLiteral(op.Regexp)), false), nil
+	case otObject:
+		return json.Marshal(op.Object)
+	case otCustom:
+		return customJSON(op.Object), nil
+	}
+	return []byte("null"), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Strings, numbers, booleans and null are stored as such,
+// arrays and objects are stored as objects ([]any and map[string]any).
+func (op *Operand) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*op = Operand{}
+	return setJSONValue(op, value)
+}
+
+// JSString returns the operand as a JavaScript literal: a double quoted string, a number (including NaN,
+// Infinity and -Infinity), true, false, null, undefined, a regexp literal or an object literal (as JSON).
+func (op *Operand) JSString() string {
+	switch op.Type {
+	case otString:
+		return string(quoteString(op.Str, true))
+	case otNumber, otBoolean, otNull, otUndefined:
+		return string(toString(op))
+	case otRegexp:
+		return regexpLiteral(op.Regexp)
+	case otObject:
+		if buf, err := json.Marshal(op.Object); err == nil {
+			return string(buf)
+		}
+	case otCustom:
+		return string(customJSON(op.Object))
+	}
+	return "undefined"
+}
+
+// formatNumber converts a number to string following JavaScript rules for NaN, infinities and negative zero.
+func formatNumber(f float64) []byte {
+	switch {
+	case math.IsNaN(f):
+		return []byte("NaN")
+	case math.IsInf(f, 1):
+		return []byte("Infinity")
+	case math.IsInf(f, -1):
+		return []byte("-Infinity")
+	case f == 0:
+		return []byte("0")
+	}
+	return strconv.AppendFloat(nil, f, 'f', -1, 64)
+}
+
+// quoteString returns a double quoted string with quotes, backslashes and control characters escaped.
+// Line and paragraph separators are escaped for JavaScript.
+func quoteString(s []byte, js bool) []byte {
+	const hex = "0123456789abcdef"
+	result := make([]byte, 0, len(s)+2)
+	result = append(result, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= 0x20 && c != '"' && c != '\\' && c < utf8.RuneSelf {
+			result = append(result, c)
+			i++
+			continue
+		}
+		switch c {
+		case '"', '\\':
+			result = append(result, '\\', c)
+		case '\n':
+			result = append(result, '\\', 'n')
+		case '\r':
+			result = append(result, '\\', 'r')
+		case '\t':
+			result = append(result, '\\', 't')
+		case '\b':
+			result = append(result, '\\', 'b')
+		case '\f':
+			result = append(result, '\\', 'f')
+		default:
+			if c < 0x20 {
+				result = append(result, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+				break
+			}
+			r, size := utf8.DecodeRune(s[i:])
+			switch {
+			case r == utf8.RuneError && size == 1:
+				result = append(result, `\ufffd`...)
+			case js && (r == '\u2028' || r == '\u2029'):
+				result = append(result, '\\', 'u', '2', '0', '2', hex[r&0xf])
+			default:
+				result = append(result, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	return append(result, '"')
+}
+
+var regexpFlags = regexp.MustCompile(`^\(\?([imsU]+)\)`)
+
+// regexpLiteral returns a regexp as `/pattern/flags` moving the leading flags group back to flags.
+func regexpLiteral(re *regexp.Regexp) string {
+	source := re.String()
+	flags := ""
+	if m := regexpFlags.FindStringSubmatch(source); m != nil {
+		source, flags = source[len(m[0]):], m[1]
+	}
+	var sb strings.Builder
+	sb.WriteByte('/')
+	escaped := false
+	for _, r := range source {
+		if r == '/' && !escaped {
+			sb.WriteByte('\\')
+		}
+		escaped = r == '\\' && !escaped
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('/')
+	sb.WriteString(flags)
+	return sb.String()
+}
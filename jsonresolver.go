@@ -0,0 +1,183 @@
+package xpression
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSONResolver resolves variables against a tree of data decoded by encoding/json (or built by hand):
+// map[string]any, []any, float64 and other numeric types, json.Number, string, bool and nil.
+// Variables are JSONPath-like references: `$` is the root node, `@` is the current node and bare names
+// are resolved relative to the current node. Examples: `$.a.b[2]['c d']`, `@.items[-1]`, `@.items.length`, `@.a[$.i + 1]`.
+// Missing keys and indexes out of range are resolved to undefined. Maps and slices are resolved to ObjectOperand.
+type JSONResolver struct {
+	Root    any // `$`
+	Current any // `@`, Root is used if nil
+
+	eval resolverContext
+}
+
+// NewJSONResolver creates a resolver for the data where the root node is also the current one.
+func NewJSONResolver(root any) *JSONResolver {
+	return &JSONResolver{Root: root}
+}
+
+// Resolve implements Resolver.
+func (r *JSONResolver) Resolve(name []byte, result *Operand) error {
+	root, path := parsePath(name)
+	return r.resolve(root, path, result)
+}
+
+// WithContext implements ContextResolver.
+func (r *JSONResolver) WithContext(ctx context.Context, limits Limits) Resolver {
+	copied := *r
+	copied.eval = resolverContext{ctx: ctx, limits: limits}
+	return &copied
+}
+
+// ResolveBatch implements BatchResolver reusing the paths parsed at compile time.
+func (r *JSONResolver) ResolveBatch(vars []VarRef, results []Operand) error {
+	for i := range vars {
+		if err := r.resolve(vars[i].Root, vars[i].Path, &results[i]); err != nil {
+			return fmt.Errorf("%s: %w", vars[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *JSONResolver) resolve(root string, path []PathElement, result *Operand) error {
+	node := r.Root
+	if root != "$" && r.Current != nil {
+		node = r.Current
+	}
+	for _, elem := range path {
+		var found bool
+		switch elem.Kind {
+		case PathKey:
+			node, found = jsonMember(node, elem.Key)
+		case PathIndex:
+			node, found = jsonIndex(node, elem.Index)
+		case PathExpression:
+			key, err := r.eval.eval(elem.Key, r.Resolve)
+			if err != nil {
+				return err
+			}
+			if key.Type == otNumber {
+				node, found = jsonIndex(node, int(key.Number))
+			} else {
+				node, found = jsonMember(node, string(toString(key)))
+			}
+		case PathCall:
+			if elem.Key != "length" || elem.Args != "" {
+				return fmt.Errorf("%w: %s()", ErrInvalidPath, elem.Key)
+			}
+			node, found = jsonMember(node, elem.Key)
+		}
+		if !found {
+			result.SetUndefined()
+			return nil
+		}
+	}
+	return setJSONValue(result, node)
+}
+
+// jsonMember returns a value of the key of an object. Arrays and strings have `length` member,
+// array elements can also be accessed by a numeric key.
+func jsonMember(node any, key string) (any, bool) {
+	switch v := node.(type) {
+	case map[string]any:
+		value, found := v[key]
+		return value, found
+	case CustomValue:
+		return customMember(v, key)
+	case []any:
+		if key == "length" {
+			return float64(len(v)), true
+		}
+		if n, err := strconv.Atoi(key); err == nil {
+			return jsonIndex(node, n)
+		}
+	case string:
+		if key == "length" {
+			return float64(utf8.RuneCountInString(v)), true
+		}
+	}
+	return nil, false
+}
+
+// jsonIndex returns an array element or a character of a string. Negative index counts from the end.
+func jsonIndex(node any, n int) (any, bool) {
+	switch v := node.(type) {
+	case []any:
+		if n < 0 {
+			n += len(v)
+		}
+		if n >= 0 && n < len(v) {
+			return v[n], true
+		}
+	case map[string]any, CustomValue:
+		return jsonMember(node, strconv.Itoa(n))
+	case string:
+		runes := []rune(v)
+		if n < 0 {
+			n += len(runes)
+		}
+		if n >= 0 && n < len(runes) {
+			return string(runes[n]), true
+		}
+	}
+	return nil, false
+}
+
+// setJSONValue stores a value decoded from JSON into the operand.
+func setJSONValue(result *Operand, value any) error {
+	switch v := value.(type) {
+	case nil:
+		result.SetNull()
+	case CustomValue:
+		result.SetCustom(v)
+	case bool:
+		result.SetBoolean(v)
+	case string:
+		result.SetString(v)
+	case float64:
+		result.SetNumber(v)
+	case float32:
+		result.SetNumber(float64(v))
+	case int:
+		result.SetNumber(float64(v))
+	case int8:
+		result.SetNumber(float64(v))
+	case int16:
+		result.SetNumber(float64(v))
+	case int32:
+		result.SetNumber(float64(v))
+	case int64:
+		result.SetNumber(float64(v))
+	case uint:
+		result.SetNumber(float64(v))
+	case uint8:
+		result.SetNumber(float64(v))
+	case uint16:
+		result.SetNumber(float64(v))
+	case uint32:
+		result.SetNumber(float64(v))
+	case uint64:
+		result.SetNumber(float64(v))
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnsupportedValue, err)
+		}
+		result.SetNumber(f)
+	case map[string]any, []any:
+		result.SetObject(v)
+	default:
+		return setReflectValue(result, reflect.ValueOf(value))
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package xpression
+
+import (
+	"fmt"
+	"strings"
+)
+
+// letExpr holds the bindings and the body of a `let name = value, ... in body` expression
+// parsed into separate expressions.
+type letExpr struct {
+	bindings []letBinding
+	body     []*Token
+}
+
+// letBinding is a named subexpression of a let expression.
+type letBinding struct {
+	name   string
+	tokens []*Token
+	pos    Position // position of the name
+}
+
+// letBounds holds the bounds of the parts of a let expression relative to its start.
+type letBounds struct {
+	names  [][2]int
+	values [][2]int
+	body   [2]int
+	end    int
+}
+
+// isLet reports whether a let expression starts at i: the `let` keyword followed by a name and `=`.
+// Otherwise `let` is an ordinary variable.
+func isLet(path []byte, i int) bool {
+	if !matchKeyword(path[i:], []byte("let")) {
+		return false
+	}
+	j, err := skipSpaces(path, i+3)
+	if err != nil || j == i+3 {
+		return false
+	}
+	e := identifierEnd(path, j)
+	if e == j {
+		return false
+	}
+	j, err = skipSpaces(path, e)
+	return err == nil && j < len(path) && path[j] == '=' && !matchSubslice(path[j:], []byte("=="))
+}
+
+// readLet reads a let expression starting at i. The bindings and the body are parsed as separate expressions;
+// positions of their tokens and errors are relative to the whole expression located by n.
+func readLet(env *Env, path []byte, i int, limits Limits, n nesting) (int, *Token, error) {
+	s := i
+	bounds, i, err := splitLet(env, path, i, n)
+	if err != nil {
+		return i, nil, err
+	}
+	part := func(b [2]int) ([]*Token, error) {
+		if isBlank(path[s+b[0] : s+b[1]]) {
+			return nil, &SyntaxError{Err: ErrInvalidBinding, Position: n.at(s + b[1]), Token: getLastWord(path[s+b[1]:])}
+		}
+		return parseTokens(env, path[s+b[0]:s+b[1]], limits, n.part(s+b[0]))
+	}
+	let := &letExpr{bindings: make([]letBinding, len(bounds.names))}
+	for k, name := range bounds.names {
+		pos := n.at(s + name[0])
+		tokens, err := part(bounds.values[k])
+		if err != nil {
+			return s, nil, err
+		}
+		let.bindings[k] = letBinding{name: string(path[s+name[0] : s+name[1]]), tokens: tokens, pos: pos}
+	}
+	if let.body, err = part(bounds.body); err != nil {
+		return s, nil, err
+	}
+	return i, &Token{Category: tcLet, Operand: Operand{Str: []byte("let")}, let: let}, nil
+}
+
+// splitLet splits a let expression starting at i into the names, the values and the body.
+// The body ends at a comma or an unmatched closing parenthesis, like an argument of a function call.
+// Returns the bounds of the parts and the end of the expression. The let expression and the nested ones
+// are recorded in n, so they are split once.
+func splitLet(env *Env, path []byte, i int, n nesting) (*letBounds, int, error) {
+	s := i
+	if bounds, found := n.lets[n.offset+s]; found {
+		return bounds, s + bounds.end, nil
+	}
+	bounds := &letBounds{}
+	i += len("let")
+	for {
+		var err error
+		if i, err = skipSpaces(path, i); err != nil {
+			return nil, i, err
+		}
+		e := identifierEnd(path, i)
+		if e == i || isReserved(path[i:e]) {
+			return nil, i, ErrInvalidBinding
+		}
+		name := [2]int{i, e}
+		if i, err = skipSpaces(path, e); err != nil {
+			return nil, i, err
+		}
+		if i == len(path) || path[i] != '=' || matchSubslice(path[i:], []byte("==")) {
+			return nil, i, ErrInvalidBinding
+		}
+		if e, err = letPartEnd(env, path, i+1, true, n); err != nil {
+			return nil, e, err
+		}
+		bounds.names = append(bounds.names, [2]int{name[0] - s, name[1] - s})
+		bounds.values = append(bounds.values, [2]int{i + 1 - s, e - s})
+		if e == len(path) || path[e] == ')' { // no `in`
+			return nil, e, ErrInvalidBinding
+		}
+		if path[e] == ',' {
+			i = e + 1
+			continue
+		}
+		i = e + len("in")
+		break
+	}
+	e, err := letPartEnd(env, path, i, false, n)
+	if err != nil {
+		return nil, e, err
+	}
+	bounds.body = [2]int{i - s, e - s}
+	bounds.end = e - s
+	n.lets[n.offset+s] = bounds
+	return bounds, e, nil
+}
+
+// letPartEnd returns the end of a binding value or a let body starting at i: a top-level comma,
+// an unmatched closing parenthesis, the end of path or, for a binding value, the `in` keyword following an operand.
+func letPartEnd(env *Env, path []byte, i int, binding bool, n nesting) (int, error) {
+	return scanPart(env, path, i, n, func(i int, prevOperator Operator) bool {
+		return path[i] == ',' || path[i] == ')' || (binding && prevOperator == opNone && matchKeyword(path[i:], []byte("in")))
+	})
+}
+
+// bindingScope is a let expression being resolved along with the enclosing ones.
+type bindingScope struct {
+	let     *letExpr
+	parent  *bindingScope
+	current int     // binding whose value is being resolved, -1 for the body
+	deps    [][]int // bindings each binding depends on
+}
+
+// lookup returns the scope and the index of the binding visible under the name, nil if there is none.
+func (s *bindingScope) lookup(name string) (*bindingScope, int) {
+	for ; s != nil; s = s.parent {
+		for n := range s.let.bindings {
+			if s.let.bindings[n].name == name {
+				return s, n
+			}
+		}
+	}
+	return nil, -1
+}
+
+// cycle returns the indices of the bindings depending on each other cyclically, nil if there are none.
+func (s *bindingScope) cycle() []int {
+	state := make([]byte, len(s.deps)) // 0 - not visited, 1 - being visited, 2 - done
+	path := make([]int, 0, len(s.deps))
+	var visit func(n int) []int
+	visit = func(n int) []int {
+		switch state[n] {
+		case 1:
+			for k := range path {
+				if path[k] == n {
+					return append(path[k:len(path):len(path)], n)
+				}
+			}
+		case 2:
+			return nil
+		}
+		state[n] = 1
+		path = append(path, n)
+		for _, dep := range s.deps[n] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[n] = 2
+		return nil
+	}
+	for n := range s.deps {
+		if cycle := visit(n); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// resolveBindings turns the variables naming let bindings in their scope into binding references
+// and checks the scopes: a binding may not shadow a binding of an enclosing let and the bindings of one let
+// may not depend on each other cyclically. In the bindings and the body of a let a bare name must be bound,
+// variables are referenced by a path (`@.x`, `$.x`) or in the custom VariableSyntax.
+// Out of any let a bound name is an ordinary variable: `x + (let x = 1 in x)`.
+func resolveBindings(tokens []*Token) error {
+	bound := collectBindings(tokens, nil)
+	if len(bound) == 0 {
+		return nil
+	}
+	return resolveScope(tokens, nil, bound)
+}
+
+// collectBindings collects the names bound by let expressions including the nested ones.
+func collectBindings(tokens []*Token, bound map[string]bool) map[string]bool {
+	for _, tok := range tokens {
+		if tok.let != nil {
+			if bound == nil {
+				bound = make(map[string]bool)
+			}
+			for _, b := range tok.let.bindings {
+				bound[b.name] = true
+			}
+		}
+		for _, sub := range tok.subexpressions() {
+			bound = collectBindings(sub, bound)
+		}
+	}
+	return bound
+}
+
+func resolveScope(tokens []*Token, scope *bindingScope, bound map[string]bool) error {
+	for _, tok := range tokens {
+		switch tok.Category {
+		case tcVariable:
+			name := string(tok.Str)
+			var s *bindingScope
+			var n int
+			if bound[name] {
+				s, n = scope.lookup(name)
+			}
+			if s == nil {
+				if scope != nil && tok.spelling == nil && isIdentifier(name) {
+					return &SyntaxError{Err: ErrUndefinedBinding, Position: tok.Pos, Token: name}
+				}
+				continue
+			}
+			tok.Category = tcBinding
+			if s.current >= 0 {
+				s.deps[s.current] = append(s.deps[s.current], n)
+			}
+		case tcFunction:
+			for _, arg := range tok.call.args {
+				if err := resolveScope(arg, scope, bound); err != nil {
+					return err
+				}
+			}
+		case tcLet:
+			if err := resolveLet(tok.let, scope, bound); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func resolveLet(let *letExpr, parent *bindingScope, bound map[string]bool) error {
+	scope := &bindingScope{let: let, parent: parent, deps: make([][]int, len(let.bindings))}
+	for n, b := range let.bindings {
+		if s, _ := parent.lookup(b.name); s != nil {
+			return &SyntaxError{Err: ErrShadowedBinding, Position: b.pos, Token: b.name}
+		}
+		for _, prev := range let.bindings[:n] {
+			if prev.name == b.name {
+				return &SyntaxError{Err: ErrDuplicateName, Position: b.pos, Token: b.name}
+			}
+		}
+	}
+	for n, b := range let.bindings {
+		scope.current = n
+		if err := resolveScope(b.tokens, scope, bound); err != nil {
+			return err
+		}
+	}
+	if cycle := scope.cycle(); cycle != nil {
+		names := make([]string, len(cycle))
+		for k, n := range cycle {
+			names[k] = let.bindings[n].name
+		}
+		b := let.bindings[cycle[0]]
+		return &SyntaxError{Err: fmt.Errorf("%w: %s", ErrCyclicBinding, strings.Join(names, " -> ")), Position: b.pos, Token: b.name}
+	}
+	scope.current = -1
+	return resolveScope(let.body, scope, bound)
+}
+
+// letScope is a let expression being evaluated along with the enclosing ones.
+type letScope struct {
+	let    *letExpr
+	values []*Operand // values of the bindings evaluated so far
+	parent *letScope
+}
+
+// evalLet evaluates the body of a let expression. A binding is evaluated on first use, at most once.
+func (ev *evaluator) evalLet(tok *Token, result *Operand) error {
+	scope := &letScope{let: tok.let, values: make([]*Operand, len(tok.let.bindings)), parent: ev.scope}
+	sub := *ev // shares the memoized variables
+	sub.scope = scope
+	value, err := sub.evaluate(tok.let.body)
+	ev.steps = sub.steps
+	if err != nil {
+		return err
+	}
+	*result = *value
+	return nil
+}
+
+// binding returns the value of the binding referenced by tok evaluating it in the scope of its let expression.
+func (ev *evaluator) binding(tok *Token) (*Operand, error) {
+	name := string(tok.Str)
+	for s := ev.scope; s != nil; s = s.parent {
+		for n := range s.let.bindings {
+			if s.let.bindings[n].name != name {
+				continue
+			}
+			if s.values[n] == nil {
+				sub := *ev
+				sub.scope = s
+				value, err := sub.evaluate(s.let.bindings[n].tokens)
+				ev.steps = sub.steps
+				if err != nil {
+					return nil, err
+				}
+				s.values[n] = value
+			}
+			return s.values[n], nil
+		}
+	}
+	return nil, ev.fail(tok, ErrUndefinedBinding)
+}
@@ -0,0 +1,25 @@
+package xpression
+
+// Limits restricts the size and complexity of an expression and the resources consumed by its evaluation.
+// A zero value of any field means "no limit", except that with no MaxDepth function calls and let expressions,
+// which are parsed and evaluated recursively, may not be nested.
+type Limits struct {
+	MaxLength int // maximum expression length in bytes
+	MaxDepth  int // maximum nesting depth of parentheses, function calls and let expressions
+	MaxNodes  int // maximum number of tokens
+
+	MaxSteps        int // maximum number of operators executed during evaluation (gas budget)
+	MaxStringLength int // maximum length of a string produced by concatenation
+	MaxRegexpInput  int // maximum length of a string matched against a regexp
+}
+
+// DefaultLimits are applied by the package-level functions (Parse, Compile, CompileList, ParseRecover, Eval* ...)
+// and by the programs they compile. Changes take effect on the next call.
+var DefaultLimits = Limits{
+	MaxLength: 64 * 1024,
+	MaxDepth:  256,
+	MaxNodes:  16 * 1024,
+
+	MaxStringLength: 1024 * 1024,
+	MaxRegexpInput:  64 * 1024,
+}
@@ -0,0 +1,307 @@
+package xpression
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// ProgramList is a compiled comma-separated list of expressions: `@.a + @.b, @.a * 0.2`,
+// or its named form: `total: @.a + @.b, tax: @.a * 0.2`. A name is an identifier or a string literal.
+// Each item is compiled into a separate Program, positions of all the items are relative to the whole list.
+type ProgramList struct {
+	source   []byte
+	names    []string // nil for an unnamed list
+	programs []*Program
+}
+
+// OrderedMap holds named results of a list in the order of the expression.
+type OrderedMap struct {
+	keys   []string
+	values map[string]*Operand
+}
+
+// CompileList parses a comma-separated list of expressions using DefaultLimits.
+func CompileList(expression []byte) (*ProgramList, error) {
+	return defaultEnv().CompileList(expression)
+}
+
+// EvalList evaluates a comma-separated list of expressions, named or not, and returns the results in order.
+// External variables can be used via varFunc.
+func EvalList(expression []byte, varFunc VariableFunc) ([]Operand, error) {
+	list, err := CompileList(expression)
+	if err != nil {
+		return nil, err
+	}
+	return list.Eval(varFunc)
+}
+
+// EvalNamed evaluates a named list of expressions `name: expr, ...` and returns the results by name.
+// External variables can be used via varFunc.
+func EvalNamed(expression []byte, varFunc VariableFunc) (*OrderedMap, error) {
+	list, err := CompileList(expression)
+	if err != nil {
+		return nil, err
+	}
+	return list.EvalNamed(varFunc)
+}
+
+// CompileList parses a comma-separated list of expressions in the environment.
+// A trailing comma is allowed. Named and unnamed items can not be mixed, names must be unique.
+func (e *Env) CompileList(expression []byte) (*ProgramList, error) {
+	limits := e.limits()
+	if limits.MaxLength > 0 && len(expression) > limits.MaxLength {
+		pos := newPositionTracker(expression).at(limits.MaxLength)
+		return nil, &LimitError{Err: ErrExpressionTooLong, Position: pos, Max: limits.MaxLength}
+	}
+	n := newNesting(expression)
+	bounds, i, err := splitList(e, expression, 0, false, n)
+	if err != nil {
+		return nil, &SyntaxError{Err: err, Position: n.at(i), Token: getLastWord(expression[i:]), Source: string(expression)}
+	}
+	if n := len(bounds); n > 1 && isBlank(expression[bounds[n-1][0]:bounds[n-1][1]]) {
+		bounds = bounds[:n-1] // trailing comma
+	}
+	list := &ProgramList{source: cloneBytes(expression)}
+	seen := make(map[string]bool)
+	for k, b := range bounds {
+		item, _ := skipSpaces(expression, b[0])
+		start := item
+		name, end, named := readListKey(expression, start)
+		if named {
+			start = end
+		}
+		if k > 0 && named != (list.names != nil) {
+			return nil, &SyntaxError{Err: ErrMixedList, Position: n.at(item), Token: getLastWord(expression[item:]), Source: string(expression)}
+		}
+		if named {
+			if seen[name] {
+				return nil, &SyntaxError{Err: ErrDuplicateName, Position: n.at(item), Token: name, Source: string(expression)}
+			}
+			seen[name] = true
+			list.names = append(list.names, name)
+		}
+		tokens, err := parseExpression(e, expression[start:b[1]], limits, n.part(start))
+		if err != nil {
+			return nil, withListSource(err, expression)
+		}
+		list.programs = append(list.programs, newProgram(e, expression, tokens))
+	}
+	return list, nil
+}
+
+// Programs returns the compiled items of the list.
+func (l *ProgramList) Programs() []*Program {
+	return l.programs
+}
+
+// Names returns the names of the items, nil for an unnamed list.
+func (l *ProgramList) Names() []string {
+	return l.names
+}
+
+// Source returns the source of the list.
+func (l *ProgramList) Source() string {
+	return string(l.source)
+}
+
+// Eval evaluates all the items using the limits of the Env (DefaultLimits unless compiled by Env.CompileList).
+// External variables can be used via varFunc.
+func (l *ProgramList) Eval(varFunc VariableFunc) ([]Operand, error) {
+	return l.EvalContext(context.Background(), varFunc, l.programs[0].env.limits())
+}
+
+// EvalContext evaluates all the items honoring ctx cancellation and the evaluation limits applied to each item.
+func (l *ProgramList) EvalContext(ctx context.Context, varFunc VariableFunc, limits Limits) ([]Operand, error) {
+	results := make([]Operand, len(l.programs))
+	for i, program := range l.programs {
+		result, err := program.EvalShared(ctx, varFunc, limits)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = *result.Clone()
+	}
+	return results, nil
+}
+
+// EvalNamed evaluates a named list. ErrUnnamedList is returned for an unnamed list.
+func (l *ProgramList) EvalNamed(varFunc VariableFunc) (*OrderedMap, error) {
+	if l.names == nil {
+		return nil, ErrUnnamedList
+	}
+	results, err := l.Eval(varFunc)
+	if err != nil {
+		return nil, err
+	}
+	m := &OrderedMap{keys: l.names, values: make(map[string]*Operand, len(results))}
+	for i := range results {
+		m.values[l.names[i]] = &results[i]
+	}
+	return m, nil
+}
+
+// Keys returns the names in the order of the expression.
+func (m *OrderedMap) Keys() []string {
+	return m.keys
+}
+
+// Get returns the value by name.
+func (m *OrderedMap) Get(key string) (*Operand, bool) {
+	value, found := m.values[key]
+	return value, found
+}
+
+// Len returns the number of values.
+func (m *OrderedMap) Len() int {
+	return len(m.keys)
+}
+
+// MarshalJSON implements json.Marshaler producing an object with the keys in order.
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(quoteString([]byte(key), false))
+		buf.WriteByte(':')
+		value, err := m.values[key].MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// splitList splits a comma-separated list starting at i into items. If closing is true the list ends at an unmatched
+// closing parenthesis (arguments of a function call), otherwise at the end of path and items may be named.
+// Returns the bounds of the items and the end of the list. The function calls and let expressions in the items
+// are recorded in n.
+func splitList(env *Env, path []byte, i int, closing bool, n nesting) ([][2]int, int, error) {
+	bounds := make([][2]int, 0, 4)
+	for {
+		start := i
+		if !closing {
+			if _, e, named := readListKey(path, i); named {
+				i = e
+			}
+		}
+		e, err := scanPart(env, path, i, n, func(i int, _ Operator) bool {
+			return path[i] == ',' || (closing && path[i] == ')')
+		})
+		if err != nil {
+			return nil, e, err
+		}
+		bounds = append(bounds, [2]int{start, e})
+		switch {
+		case e == len(path) && closing:
+			return nil, e, ErrMismatchedParentheses
+		case e == len(path):
+			return bounds, e, nil
+		case path[e] == ')':
+			return bounds, e + 1, nil
+		}
+		i = e + 1
+	}
+}
+
+// scanPart returns the end of an expression part starting at i: the first position outside of parentheses
+// where stop returns true or the end of path. stop is given the position of the next token and the preceding
+// operator, opNone after an operand. Nested function calls and let expressions are skipped as a whole
+// and recorded in n; commas in parentheses and brackets are left to the parser of the part.
+func scanPart(env *Env, path []byte, i int, n nesting, stop func(i int, prevOperator Operator) bool) (int, error) {
+	depth := 0
+	prevOperator := opPlus
+	for {
+		var err error
+		if i, err = skipSpaces(path, i); err != nil {
+			return i, err
+		}
+		if i == len(path) || (depth == 0 && stop(i, prevOperator)) {
+			return i, nil
+		}
+		if path[i] == ',' { // reported by the parser of the part
+			i++
+			continue
+		}
+		if nested := env.function(path, i); nested != nil {
+			if _, e, err := splitCall(env, path, i, nested, n); err == nil {
+				i = e
+			} else { // reported by the parser of the call
+				i = skipBracket(path, i+len(nested.name), '(', ')')
+			}
+			prevOperator = opNone
+			continue
+		}
+		if prevOperator != opNone && isLet(path, i) {
+			if _, i, err = splitLet(env, path, i, n); err != nil {
+				return i, err
+			}
+			prevOperator = opNone
+			continue
+		}
+		t := i
+		var tok *Token
+		if i, tok, err = readNextToken(env, path, i, prevOperator); err != nil {
+			return i, err
+		}
+		switch tok.Category {
+		case tcVariable: // a variable name does not end at a comma in brackets: `@.a[1,2]`
+			i = t + argumentEnd(path[t:i])
+			prevOperator = tok.Operator
+		case tcLeftParenthesis:
+			depth++
+			prevOperator = tok.Operator
+		case tcRightParenthesis:
+			depth--
+			prevOperator = opNone
+		default:
+			prevOperator = tok.Operator
+		}
+	}
+}
+
+// readListKey reads the name of a list item at i: an identifier or a string literal immediately followed by a colon.
+// A blank before the colon ends the key, so `x :cur` is the operand x followed by the named parameter :cur
+// (an error) rather than the item x named cur. Returns the name and the position after the colon.
+func readListKey(path []byte, i int) (string, int, bool) {
+	i, err := skipSpaces(path, i)
+	if err != nil || i == len(path) {
+		return "", i, false
+	}
+	var name string
+	e := identifierEnd(path, i)
+	switch {
+	case e > i:
+		name = string(path[i:e])
+	case path[i] == '"' || path[i] == '\'':
+		if e, err = skipString(path, i); err != nil {
+			return "", i, false
+		}
+		name = string(unescapeString(path[i+1 : e-1]))
+	default:
+		return "", i, false
+	}
+	if e == len(path) || path[e] != ':' || (e+1 < len(path) && path[e+1] == ':') {
+		return "", i, false
+	}
+	return name, e + 1, true
+}
+
+// isBlank reports whether input consists of whitespace and comments only.
+func isBlank(input []byte) bool {
+	e, err := skipSpaces(input, 0)
+	return err == nil && e == len(input)
+}
+
+// withListSource sets the source of the list to a parsing error of an item.
+func withListSource(err error, source []byte) error {
+	var syntaxErr *SyntaxError
+	if errors.As(err, &syntaxErr) {
+		syntaxErr.Source = string(source)
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package xpression
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Parameter is a bind parameter of a prepared expression: positional `?`, numbered `$1` or named `:name`.
+// A parameter may have a type hint checked by Program.Bind: `?::number`, `$1::string`, `:flag::boolean`.
+type Parameter struct {
+	Name  string      // name of a named parameter, empty for positional and numbered ones
+	Index int         // 1-based index of a positional or numbered parameter, 0 for named ones
+	Type  OperandType // type hint, 0 if none
+	Pos   Position    // start of the first occurrence
+	End   Position    // end of the first occurrence
+}
+
+// String returns the canonical spelling of the parameter: `$1` or `:name`.
+func (p Parameter) String() string {
+	if p.Name != "" {
+		return ":" + p.Name
+	}
+	return "$" + strconv.Itoa(p.Index)
+}
+
+// NamedArg is a value of a named parameter passed to Program.Bind.
+type NamedArg struct {
+	Name  string
+	Value any
+}
+
+// Named creates a value of a named parameter: program.Bind(100, xpression.Named("cur", "USD")).
+func Named(name string, value any) NamedArg {
+	return NamedArg{Name: name, Value: value}
+}
+
+// parameterTypes are the type hints accepted after `::`
+var parameterTypes = map[string]OperandType{
+	"string":  otString,
+	"number":  otNumber,
+	"boolean": otBoolean,
+	"bool":    otBoolean,
+}
+
+// readParameter reads a bind parameter at i: `?`, `$1` or `:name` followed by an optional type hint.
+// The token keeps the canonical spelling in Str (positional parameters are numbered later, see numberParameters)
+// and the type hint in Type. Returns ErrUnknownToken if there is no parameter at i.
+func readParameter(path []byte, i int) (int, *Token, error) {
+	s := i
+	var key []byte
+	switch {
+	case path[i] == '?':
+		key = []byte{'?'}
+		i++
+	case path[i] == '$' && i+1 < len(path) && path[i+1] >= '0' && path[i+1] <= '9':
+		for i++; i < len(path) && path[i] >= '0' && path[i] <= '9'; i++ {
+		}
+		n, err := strconv.Atoi(string(path[s+1 : i]))
+		if err != nil || n == 0 || identifierEnd(path, i) > i {
+			return s, nil, ErrInvalidParameter
+		}
+		key = []byte("$" + strconv.Itoa(n))
+	case path[i] == ':' && identifierEnd(path, i+1) > i+1:
+		i = identifierEnd(path, i+1)
+		key = cloneBytes(path[s:i])
+	default:
+		return s, nil, ErrUnknownToken
+	}
+	if i < len(path) && (path[i] == '.' || path[i] == '[') { // parameters are values, not paths
+		return s, nil, ErrInvalidParameter
+	}
+	tok := &Token{Category: tcParameter, Operand: Operand{Str: key}}
+	if matchSubslice(path[i:], []byte("::")) {
+		e := identifierEnd(path, i+2)
+		hint, found := parameterTypes[string(path[i+2:e])]
+		if !found {
+			return s, nil, ErrInvalidParameter
+		}
+		tok.Type = hint
+		i = e
+	}
+	tok.spelling = cloneBytes(path[s:i])
+	return i, tok, nil
+}
+
+// numberParameters numbers positional parameters in the order of appearance.
+// Positional and numbered parameters can not be mixed in one expression.
+func numberParameters(tokens []*Token) error {
+	params := collectParameters(tokens, nil)
+	sort.SliceStable(params, func(i, j int) bool { return params[i].Pos.Offset < params[j].Pos.Offset })
+	positional, numbered := 0, 0
+	for _, tok := range params {
+		switch {
+		case string(tok.Str) == "?":
+			positional++
+			tok.Str = []byte("$" + strconv.Itoa(positional))
+		case tok.Str[0] == '$':
+			numbered++
+		default:
+			continue
+		}
+		if positional > 0 && numbered > 0 {
+			return &SyntaxError{Err: ErrMixedParameters, Position: tok.Pos, Token: tok.String()}
+		}
+	}
+	return nil
+}
+
+// collectParameters appends parameter tokens including the ones used in function arguments and let expressions.
+func collectParameters(tokens []*Token, params []*Token) []*Token {
+	for _, tok := range tokens {
+		if tok.Category == tcParameter {
+			params = append(params, tok)
+		}
+		for _, sub := range tok.subexpressions() {
+			params = collectParameters(sub, params)
+		}
+	}
+	return params
+}
+
+// parameters collects distinct parameters: positional and numbered ones by index, then named ones
+// in the order of their first use.
+func parameters(tokens []*Token) []Parameter {
+	params := collectParameters(tokens, nil)
+	sort.SliceStable(params, func(i, j int) bool { return params[i].Pos.Offset < params[j].Pos.Offset })
+	result := make([]Parameter, 0, len(params))
+	index := make(map[string]int)
+	for _, tok := range params {
+		if n, found := index[string(tok.Str)]; found {
+			if result[n].Type == 0 {
+				result[n].Type = tok.Type
+			}
+			continue
+		}
+		param := Parameter{Type: tok.Type, Pos: tok.Pos, End: tok.End}
+		if tok.Str[0] == ':' {
+			param.Name = string(tok.Str[1:])
+		} else {
+			param.Index, _ = strconv.Atoi(string(tok.Str[1:]))
+		}
+		index[string(tok.Str)] = len(result)
+		result = append(result, param)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Index > 0 && (result[j].Index == 0 || result[i].Index < result[j].Index)
+	})
+	return result
+}
+
+// Parameters returns distinct bind parameters of the program: positional and numbered ones by index,
+// then named ones in the order of their first use.
+func (p *Program) Parameters() []Parameter {
+	return p.parameters
+}
+
+// Bind substitutes values of the bind parameters and folds the constant subexpressions returning a new Program.
+// Positional and numbered parameters take values of args in order, named parameters take NamedArg values.
+// Values are converted with FromValue. An error is returned if a parameter has no value, a value has no parameter
+// or a value does not match the type hint of its parameter.
+func (p *Program) Bind(args ...any) (*Program, error) {
+	values := make(map[string]*Operand, len(args))
+	positional := 0
+	for _, arg := range args {
+		var key string
+		if named, ok := arg.(NamedArg); ok {
+			key, arg = ":"+named.Name, named.Value
+		} else {
+			positional++
+			key = "$" + strconv.Itoa(positional)
+		}
+		value, err := FromValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[key] = value
+	}
+	for _, param := range p.parameters {
+		value, found := values[param.String()]
+		if !found {
+			return nil, withSource(&EvalError{Err: ErrMissingParameter, Position: param.Pos, Token: param.String()}, p.source)
+		}
+		if param.Type != 0 && value.Type&param.Type == 0 {
+			return nil, fmt.Errorf("%s: %w", param, &TypeError{From: value.Type, Value: value.String(), To: param.Type.String()})
+		}
+	}
+	if len(values) > len(p.parameters) {
+		for key := range values {
+			if !p.hasParameter(key) {
+				return nil, fmt.Errorf("%w: %s", ErrExtraParameter, key)
+			}
+		}
+	}
+	ev := p.evaluator(context.Background(), nil, p.env.limits())
+	tokens, err := ev.partial(p.tokens, nil, values)
+	if err != nil {
+		return nil, withSource(err, p.source)
+	}
+	return newProgram(p.env, p.source, tokens), nil
+}
+
+func (p *Program) hasParameter(key string) bool {
+	for _, param := range p.parameters {
+		if param.String() == key {
+			return true
+		}
+	}
+	return false
+}
@@ -1,20 +1,115 @@
 package xpression
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Parse parses the expression into a list of tokens in prefix notation (NPN) using DefaultLimits.
 func Parse(path []byte) ([]*Token, error) {
+	return ParseWithLimits(path, DefaultLimits)
+}
+
+// ParseWithLimits parses the expression the same way Parse does but checks it against the given limits.
+// A *LimitError is returned if the expression is too long, too deep or consists of too many tokens.
+// Other parsing errors, including misplaced operands and operators and unbalanced parentheses, are returned as *SyntaxError.
+func ParseWithLimits(path []byte, limits Limits) ([]*Token, error) {
+	return parse(defaultEnv(), path, limits)
+}
+
+func parse(env *Env, path []byte, limits Limits) ([]*Token, error) {
+	return parseExpression(env, path, limits, newNesting(path))
+}
+
+// parseExpression parses a complete expression located by n: the whole expression or an item of a list.
+func parseExpression(env *Env, path []byte, limits Limits, n nesting) ([]*Token, error) {
+	tokens, err := parseTokens(env, path, limits, n)
+	if err != nil {
+		return nil, err
+	}
+	if err := numberParameters(tokens); err != nil {
+		err.(*SyntaxError).Source = string(path)
+		return nil, err
+	}
+	if err := resolveBindings(tokens); err != nil {
+		err.(*SyntaxError).Source = string(path)
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// nesting locates a part of the expression parsed separately, e.g. an argument of a function call, in the whole expression.
+// The parts of an expression share the position tracker and the function calls and let expressions split along with
+// the enclosing parts, so the nested parts are not scanned again.
+type nesting struct {
+	depth   int                 // nesting level of the part
+	nested  bool                // the part belongs to a function call or a let expression
+	offset  int                 // offset of the part in the whole expression
+	tracker *positionTracker    // positions in the whole expression
+	calls   map[int]*callBounds // function calls by offset in the whole expression
+	lets    map[int]*letBounds  // let expressions by offset in the whole expression
+}
+
+func newNesting(path []byte) nesting {
+	return nesting{tracker: newPositionTracker(path), calls: make(map[int]*callBounds), lets: make(map[int]*letBounds)}
+}
+
+// at returns the position of offset i of the part in the whole expression.
+func (n nesting) at(i int) Position {
+	return n.tracker.at(n.offset + i)
+}
+
+// part returns the nesting of a part starting at offset i of this one.
+func (n nesting) part(i int) nesting {
+	n.offset += i
+	return n
+}
+
+// enter returns the nesting of the parts of a function call or a let expression starting at offset i at the given depth.
+// The parts are parsed and evaluated recursively, so with no MaxDepth the calls and lets may not be nested.
+func (n nesting) enter(i, depth int, limits Limits) (nesting, error) {
+	if (limits.MaxDepth > 0 && depth >= limits.MaxDepth) || (limits.MaxDepth == 0 && n.nested) {
+		return n, &LimitError{Err: ErrNestingTooDeep, Position: n.at(i), Max: limits.MaxDepth}
+	}
+	n.depth = depth + 1
+	n.nested = true
+	return n, nil
+}
+
+// parseTokens parses the expression, an argument of a function call or a part of a let expression.
+func parseTokens(env *Env, path []byte, limits Limits, n nesting) ([]*Token, error) {
+	if limits.MaxLength > 0 && len(path) > limits.MaxLength {
+		return nil, &LimitError{Err: ErrExpressionTooLong, Position: n.at(limits.MaxLength), Max: limits.MaxLength}
+	}
 
-	tokens, err := lexer(path)
+	tokens, err := lexer(env, path, limits, n, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return parser(tokens)
+	tokens, err = balance(tokens, nil)
+	if err == nil {
+		tokens, err = parser(tokens)
+	}
+	if err != nil {
+		var syntaxErr *SyntaxError
+		if errors.As(err, &syntaxErr) {
+			syntaxErr.Source = string(path)
+		}
+		return nil, err
+	}
+	return tokens, nil
 }
 
-func lexer(path []byte) ([]*Token, error) {
+// lexer splits the expression into tokens.
+// If diags is nil the first error is returned. Otherwise the errors are collected into diags
+// and the malformed parts of the expression are returned as tcInvalid or tcUnknown tokens.
+// A function call and a let expression count as one nesting level like a parenthesis.
+func lexer(env *Env, path []byte, limits Limits, n nesting, diags *[]Diagnostic) ([]*Token, error) {
+	source := path
 	path = path[:trimSpaces(path)]
 	l := len(path)
 	i := 0
@@ -22,28 +117,138 @@ func lexer(path []byte) ([]*Token, error) {
 	tokens := make([]*Token, 0)
 	var tok *Token
 	var err error
+	depth := n.depth
 	prevOperator := opPlus
+	var last *Token       // last token comments can be attached to
+	var leading []Comment // comments preceding the next token
 	for i < l {
-		i, tok, err = readNextToken(path, i, prevOperator)
+		s := i
+		i, err = skipSpaces(path, i)
 		if err != nil {
-			return nil, fmt.Errorf("%w at %d: %s", err, i, getLastWord(path[i:]))
+			return nil, &SyntaxError{Err: err, Position: n.at(i), Token: getLastWord(path[i:]), Source: string(source)}
+		}
+		for _, span := range commentSpans(path[s:i]) {
+			comment := Comment{Text: string(path[s+span[0] : s+span[1]]), Pos: n.at(s + span[0]), End: n.at(s + span[1])}
+			if last != nil && comment.Pos.Line == last.End.Line {
+				comment.Trailing = true
+				last.Comments = append(last.Comments, comment)
+			} else {
+				leading = append(leading, comment)
+			}
+		}
+		if i == l {
+			break
+		}
+		s = i
+		pos := n.at(s) // before the nested parts of the token move the tracker forward
+		if def := env.function(path, i); def != nil {
+			parts, limitErr := n.enter(i, depth, limits)
+			if limitErr != nil {
+				return nil, limitErr
+			}
+			i, tok, err = readCall(env, path, i, def, limits, parts)
+		} else if prevOperator != opNone && isLet(path, i) {
+			parts, limitErr := n.enter(i, depth, limits)
+			if limitErr != nil {
+				return nil, limitErr
+			}
+			i, tok, err = readLet(env, path, i, limits, parts)
+		} else {
+			i, tok, err = readNextToken(env, path, i, prevOperator)
+		}
+		if err != nil {
+			var limitErr *LimitError
+			if errors.As(err, &limitErr) {
+				return nil, err
+			}
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				syntaxErr = &SyntaxError{Err: err, Position: n.at(i), Token: getLastWord(path[i:])}
+			}
+			syntaxErr.Source = string(source)
+			if diags == nil {
+				return nil, syntaxErr
+			}
+			addDiagnostic(diags, syntaxErr)
+			i, tok = skipInvalid(env, path, i, err)
 		}
 		if tok != nil {
-			prevOperator = tok.Operator
+			tok.Pos = pos
+			tok.End = n.at(i)
+			if tok.Category == tcVariable {
+				tok.env = env
+			}
+			switch tok.Category {
+			case tcLeftParenthesis:
+				depth++
+				if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+					return nil, &LimitError{Err: ErrNestingTooDeep, Position: tok.Pos, Max: limits.MaxDepth}
+				}
+			case tcRightParenthesis:
+				depth--
+			}
+			if limits.MaxNodes > 0 && len(tokens) >= limits.MaxNodes {
+				return nil, &LimitError{Err: ErrTooManyTokens, Position: tok.Pos, Max: limits.MaxNodes}
+			}
+			switch tok.Category {
+			case tcUnknown:
+			case tcRightParenthesis:
+				prevOperator = opNone // closing parenthesis ends an operand: `(4) / 2`, `(2) - 1`
+			default:
+				prevOperator = tok.Operator
+			}
+			if tok.Category&(tcLeftParenthesis|tcRightParenthesis|tcUnknown) == 0 { // parentheses are not a part of the tree
+				tok.Comments = append(tok.Comments, leading...)
+				leading = nil
+				last = tok
+			}
 			tokens = append(tokens, tok)
 		}
 	}
+	if last != nil {
+		for _, comment := range leading { // comments at the end of the expression
+			comment.Trailing = true
+			last.Comments = append(last.Comments, comment)
+		}
+	}
 	return tokens, nil
 }
 
+// skipInvalid skips a malformed token starting at i and returns it as tcInvalid (malformed literal)
+// or tcUnknown (unrecognized character) token.
+func skipInvalid(env *Env, path []byte, i int, err error) (int, *Token) {
+	s := i
+	l := len(path)
+	switch {
+	case errors.Is(err, ErrUnknownToken), errors.Is(err, ErrUnexpectedComma):
+		_, size := utf8.DecodeRune(path[i:])
+		i += size
+		return i, &Token{Category: tcUnknown, Operand: Operand{Str: cloneBytes(path[s:i])}}
+	case path[i] == '"' || path[i] == '\'' || path[i] == '`':
+		i = l // unterminated string
+	case path[i] == '/':
+		for i++; i < l && !(path[i] == '/' && path[i-1] != '\\'); i++ {
+		}
+		for i++; i < l && strings.IndexByte(env.RegexpFlags, path[i]) >= 0; i++ {
+		}
+	default:
+		for i++; i < l && (isAlphanumeric(path[i]) || path[i] == '.'); i++ {
+		}
+	}
+	if i > l {
+		i = l
+	}
+	return i, &Token{Category: tcInvalid, Operand: Operand{Str: cloneBytes(path[s:i])}}
+}
+
 func parser(tokens []*Token) ([]*Token, error) {
 	opStack := new(tokenStack)
 	result := new(tokenStack)
 	for _, token := range reverse(tokens) {
 		switch token.Category {
-		case tcLiteral:
+		case tcLiteral, tcInvalid, tcParameter:
 			result.push(token)
-		case tcVariable:
+		case tcVariable, tcFunction, tcLet:
 			result.pushDouble(&Token{}, token)
 		case tcOperator:
 			for {
@@ -54,9 +259,9 @@ func parser(tokens []*Token) ([]*Token, error) {
 				if top.Category == tcRightParenthesis {
 					break
 				}
-				tokenPrecedence := operatorDetails[token.Operator].Precedence
-				topPrecedence := operatorDetails[top.Operator].Precedence
-				tokenAssociativity := operatorDetails[token.Operator].Associativity
+				tokenPrecedence := token.detail().Precedence
+				topPrecedence := top.detail().Precedence
+				tokenAssociativity := token.detail().Associativity
 				if tokenPrecedence < topPrecedence || (tokenPrecedence == topPrecedence && tokenAssociativity == aRight) {
 					result.pushDouble(opStack.popDouble())
 					continue
@@ -70,7 +275,7 @@ func parser(tokens []*Token) ([]*Token, error) {
 			for {
 				top := opStack.peek()
 				if top == nil {
-					return nil, errMismatchedParentheses
+					return nil, &SyntaxError{Err: ErrMismatchedParentheses, Position: token.Pos, Token: token.String()}
 				}
 				if top.Category == tcRightParenthesis {
 					opStack.pop()
@@ -88,12 +293,16 @@ func parser(tokens []*Token) ([]*Token, error) {
 	return reverse(result.get()), nil
 }
 
-func readNextToken(path []byte, i int, prevOperator Operator) (int, *Token, error) {
+func readNextToken(env *Env, path []byte, i int, prevOperator Operator) (int, *Token, error) {
 	var err error
 	i, err = skipSpaces(path, i)
 	if err != nil {
 		return i, nil, err
 	}
+	// a top-level comma separates items of a list, see CompileList
+	if path[i] == ',' {
+		return i, nil, ErrUnexpectedComma
+	}
 	// parentheses
 	if path[i] == '(' {
 		return i + 1, &Token{Category: tcLeftParenthesis, Operator: opLeftParenthesis}, nil
@@ -101,16 +310,45 @@ func readNextToken(path []byte, i int, prevOperator Operator) (int, *Token, erro
 	if path[i] == ')' {
 		return i + 1, &Token{Category: tcRightParenthesis, Operator: opRightParenthesis}, nil
 	}
-	// operator
-	for _, op := range operatorSpelling {
-		if matchSubslice(path[i:], op.Spelling) {
-			if op.Code == opDivide && prevOperator != opNone {
-				return readRegexp(path, i)
+	// variable in a custom syntax
+	if env.VariableSyntax != nil && prevOperator != opNone {
+		if n, name, err := env.VariableSyntax(path[i:]); err != nil || n > 0 {
+			if err != nil {
+				return i, nil, err
+			}
+			if n > len(path)-i || len(name) == 0 {
+				return i, nil, ErrInvalidPath
 			}
-			if op.Code == opMinus && prevOperator != opNone {
-				op.Code = opUnaryMinus
+			return i + n, &Token{Category: tcVariable, Operand: Operand{Type: otVariable, Str: cloneBytes(name)}, spelling: cloneBytes(path[i : i+n])}, nil
+		}
+	}
+	// bind parameter
+	if path[i] == '?' || path[i] == '$' || path[i] == ':' {
+		if e, tok, err := readParameter(path, i); !errors.Is(err, ErrUnknownToken) {
+			return e, tok, err
+		}
+	}
+	// operator
+	if op := env.match(path[i:], prevOperator != opNone); op != nil {
+		if op.code == opDivide && prevOperator != opNone {
+			if env.DisableRegexp {
+				return i, nil, ErrFeatureDisabled
 			}
-			return i + len(op.Spelling), &Token{Category: tcOperator, Operator: op.Code}, nil
+			return readRegexp(path, i, env.RegexpFlags)
+		}
+		if env.DisableBitwise && op.fn == nil && isBitwise(op.code) {
+			return i, nil, ErrFeatureDisabled
+		}
+		tok := &Token{Category: tcOperator, Operator: op.code}
+		if op.fn != nil || op.overload != nil {
+			tok.def = op
+		}
+		return i + len(op.spelling), tok, nil
+	}
+	// keyword operator
+	if env.KeywordOperators {
+		if n, code := readKeyword(path, i); n > 0 {
+			return i + n, &Token{Category: tcOperator, Operator: code, def: env.builtin(code)}, nil
 		}
 	}
 	// literal:
@@ -122,40 +360,107 @@ func readNextToken(path []byte, i int, prevOperator Operator) (int, *Token, erro
 	if path[i] == '"' || path[i] == '\'' {
 		return readString(path, i)
 	}
-	// bool or null
-	i, tok, err := readBoolNull(path, i)
+	// true, false, null, undefined, NaN, Infinity
+	i, tok, err := readKeywordLiteral(path, i)
 	if err == nil {
 		return i, tok, nil
 	}
+	// escaped variable
+	if path[i] == '`' {
+		return readEscapedVar(path, i, env.bound)
+	}
 	// variable
-	if (path[i] >= 'a' && path[i] <= 'z') || (path[i] >= 'A' && path[i] <= 'Z') || path[i] == '$' || path[i] == '@' {
-		return readVar(path, i)
+	if identifierEnd(path, i) > i || strings.IndexByte(env.VariableStart, path[i]) >= 0 {
+		return readVar(path, i, env.bound)
 	}
 
-	return i, nil, errUnknownToken
+	return i, nil, ErrUnknownToken
 }
 
+// skipSpaces skips whitespace and comments.
 func skipSpaces(input []byte, i int) (int, error) {
 	l := len(input)
-	for ; i < l; i++ {
-		if !bytein(input[i], []byte{' ', ',', '\t', '\r', '\n'}) {
-			break
+	for i < l {
+		if bytein(input[i], []byte{' ', '\t', '\r', '\n'}) {
+			i++
+			continue
+		}
+		e, err := skipComment(input, i)
+		if err != nil || e == i {
+			return e, err
+		}
+		i = e
+	}
+	return i, nil
+}
+
+// skipComment skips a `/* block */` or `// line` comment starting at i. Returns i if there is no comment.
+func skipComment(input []byte, i int) (int, error) {
+	switch {
+	case matchSubslice(input[i:], []byte("//")):
+		if e := bytes.IndexByte(input[i:], '\n'); e >= 0 {
+			return i + e, nil
 		}
+		return len(input), nil
+	case matchSubslice(input[i:], []byte("/*")):
+		if e := bytes.Index(input[i+2:], []byte("*/")); e >= 0 {
+			return i + e + 4, nil
+		}
+		return i, ErrUnterminatedComment
 	}
 	return i, nil
 }
 
+// commentSpans returns the spans of comments in a sequence skipped by skipSpaces.
+func commentSpans(input []byte) [][2]int {
+	var spans [][2]int
+	for i := 0; i < len(input); i++ {
+		if e, _ := skipComment(input, i); e > i {
+			spans = append(spans, [2]int{i, e})
+			i = e - 1
+		}
+	}
+	return spans
+}
+
 func trimSpaces(input []byte) int {
 	l := len(input)
 	i := l - 1
 	for ; i >= 0; i-- {
-		if !bytein(input[i], []byte{' ', ',', '\t', '\r', '\n'}) {
+		if !bytein(input[i], []byte{' ', '\t', '\r', '\n'}) {
 			break
 		}
 	}
 	return i + 1
 }
 
+// isIdentStart reports whether r can start an identifier: a Unicode letter (ID_Start) or an underscore.
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.In(r, unicode.Nl, unicode.Other_ID_Start)
+}
+
+// isIdentContinue reports whether r can continue an identifier (ID_Continue).
+func isIdentContinue(r rune) bool {
+	return isIdentStart(r) || unicode.In(r, unicode.Mn, unicode.Mc, unicode.Nd, unicode.Pc, unicode.Other_ID_Continue)
+}
+
+// identifierEnd returns the end of an identifier starting at i, i if there is none.
+func identifierEnd(input []byte, i int) int {
+	for j := i; j < len(input); {
+		r, size := utf8.DecodeRune(input[j:])
+		if !isIdentContinue(r) || (j == i && !isIdentStart(r)) {
+			return j
+		}
+		j += size
+	}
+	return len(input)
+}
+
+// returns true if b is an ASCII letter, digit or underscore
+func isAlphanumeric(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '_'
+}
+
 // returns true if b matches one of the elements of seq
 func bytein(b byte, seq []byte) bool {
 	for i := 0; i < len(seq); i++ {
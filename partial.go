@@ -0,0 +1,160 @@
+package xpression
+
+import (
+	"context"
+)
+
+// PartialEval substitutes the known variables into the program, folds constant subexpressions and prunes
+// the branches of logical operators determined by a constant left operand (`false && @.x` -> `false`, `true && @.x` -> `@.x`).
+// The result is a new, usually smaller, Program which can be evaluated later with the remaining variables.
+// If all the variables used are known, the resulting program is a single value available via Program.Value.
+// The known variables are matched by name exactly as they are written in the expression (see VarRef.Name).
+// Function calls and let expressions are never folded, only their arguments and parts are.
+func PartialEval(program *Program, known map[string]*Operand) (*Program, error) {
+	ev := program.evaluator(context.Background(), nil, program.env.limits())
+	result, err := ev.partial(program.tokens, known, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newProgram(program.env, program.source, result), nil
+}
+
+// partial implements PartialEval and Program.Bind for a list of tokens.
+func (ev *evaluator) partial(tokens []*Token, known, params map[string]*Operand) ([]*Token, error) {
+	n := len(tokens)
+	value := make([]*Operand, n)         // constant value of a subtree starting at i, nil if the subtree is not constant
+	end := make([]int, n)                // end of a subtree starting at i
+	prune := make([]int, n)              // start of a subtree replacing the subtree starting at i, 0 if none
+	calls := make(map[int]*functionCall) // function calls with folded arguments
+	lets := make(map[int]*letExpr)       // let expressions with folded parts
+
+	stack := make([]int, 0, 16) // subtree starts
+	for i := n - 1; i >= 0; i-- {
+		tok := tokens[i]
+		switch tok.Category {
+		case tcLiteral:
+			end[i] = i + 1
+			value[i] = &tok.Operand
+		case tcVariable:
+			end[i] = i + 1 + tokenResult
+			if op, found := known[string(tok.Str)]; found {
+				value[i] = op
+			}
+		case tcParameter:
+			end[i] = i + 1
+			if op, found := params[string(tok.Str)]; found {
+				value[i] = op
+			}
+		case tcFunction: // never folded, the function may depend on anything
+			end[i] = i + 1 + tokenResult
+			call := &functionCall{def: tok.call.def, args: make([][]*Token, len(tok.call.args))}
+			for a, arg := range tok.call.args {
+				folded, err := ev.partial(arg, known, params)
+				if err != nil {
+					return nil, err
+				}
+				call.args[a] = folded
+			}
+			calls[i] = call
+		case tcLet: // never folded, only its parts are
+			end[i] = i + 1 + tokenResult
+			let := &letExpr{bindings: make([]letBinding, len(tok.let.bindings))}
+			for b, binding := range tok.let.bindings {
+				folded, err := ev.partial(binding.tokens, known, params)
+				if err != nil {
+					return nil, err
+				}
+				let.bindings[b] = letBinding{name: binding.name, tokens: folded, pos: binding.pos}
+			}
+			body, err := ev.partial(tok.let.body, known, params)
+			if err != nil {
+				return nil, err
+			}
+			let.body = body
+			lets[i] = let
+		case tcBinding:
+			end[i] = i + 1 + tokenResult
+		case tcOperator:
+			left, right := -1, -1
+			if len(stack) < tok.detail().Arguments {
+				return nil, ev.fail(tok, ErrNotEnoughArguments)
+			}
+			left, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			end[i] = end[left]
+			if tok.detail().Arguments > 1 {
+				right, stack = stack[len(stack)-1], stack[:len(stack)-1]
+				end[i] = end[right]
+			}
+			if err := ev.fold(tok, i, left, right, value, prune); err != nil {
+				return nil, err
+			}
+		case tcIntermediateResult:
+			continue
+		default:
+			return nil, ev.fail(tok, ErrUnknownToken)
+		}
+		stack = append(stack, i)
+	}
+	if len(stack) != 1 {
+		return nil, &EvalError{Err: ErrNotEnoughArguments}
+	}
+
+	// emit the remaining tokens replacing constant subtrees with literals
+	result := make([]*Token, 0, n)
+	for i := 0; i < n; {
+		tok := tokens[i]
+		switch {
+		case value[i] != nil:
+			result = append(result, &Token{Category: tcLiteral, Operand: *value[i], Pos: tok.Pos, End: tok.End})
+			i = end[i]
+		case prune[i] > 0:
+			i = prune[i]
+		case tok.Category == tcParameter: // unbound parameter
+			copied := *tok
+			result = append(result, &copied)
+			i++
+		default: // operator, unknown variable, binding, function call or let expression followed by the result placeholder
+			copied := *tok
+			if call, found := calls[i]; found {
+				copied.call = call
+			}
+			if let, found := lets[i]; found {
+				copied.let = let
+			}
+			result = append(result, &copied, &Token{})
+			i += 1 + tokenResult
+		}
+	}
+	return result, nil
+}
+
+// fold computes the value of an operator at i if its operands are constant. For logical operators with
+// a constant left operand it either computes the value or marks the operator to be replaced by its right operand.
+func (ev *evaluator) fold(tok *Token, i, left, right int, value []*Operand, prune []int) error {
+	lval := value[left]
+	if lval == nil {
+		return nil
+	}
+	if tok.Operator == opLogicalAND || tok.Operator == opLogicalOR {
+		if (tok.Operator == opLogicalAND) != toBoolean(lval) { // false AND ..., true OR ... -> left
+			value[i] = lval
+		} else if value[right] != nil {
+			value[i] = value[right]
+		} else {
+			prune[i] = right
+		}
+		return nil
+	}
+	var rval *Operand
+	if right >= 0 {
+		if rval = value[right]; rval == nil {
+			return nil
+		}
+	}
+	result := &Operand{}
+	if err := ev.execToken(tok, lval, rval, result); err != nil {
+		return ev.fail(tok, err)
+	}
+	value[i] = result
+	return nil
+}
@@ -0,0 +1,111 @@
+package xpression
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// PathElementKind is a kind of a variable path element.
+type PathElementKind byte
+
+const (
+	PathKey        PathElementKind = iota // `.key` or `['key']`
+	PathIndex                             // `[2]`, `[-1]`
+	PathExpression                        // `[$.i + 1]`: an expression in brackets, Key holds its source
+	PathCall                              // `.length()`: Key holds the function name, Args holds the arguments source
+)
+
+// PathElement is a single step of a variable path.
+type PathElement struct {
+	Kind  PathElementKind
+	Key   string
+	Index int
+	Args  string
+}
+
+// parsePath splits a variable into its root (`$`, `@` or empty for bare names) and a list of path elements.
+// Examples: `@.a.b[2]['c d']` -> "@", [a b 2 "c d"]; `foo.length()` -> "", [foo length()].
+func parsePath(name []byte) (string, []PathElement) {
+	root := ""
+	path := make([]PathElement, 0)
+	l := len(name)
+	i := 0
+	if i < l && (name[i] == '$' || name[i] == '@') {
+		root = string(name[i])
+		i++
+	}
+	for i < l {
+		switch name[i] {
+		case '.':
+			i++
+			continue
+		case '[':
+			e := skipBracket(name, i, '[', ']')
+			path = append(path, bracketElement(bytes.TrimSpace(bracketContent(name, i, e, ']'))))
+			i = e
+			continue
+		}
+		s := i
+		for i < l && !bytein(name[i], []byte{'.', '[', '('}) {
+			i++
+		}
+		if i < l && name[i] == '(' {
+			e := skipBracket(name, i, '(', ')')
+			path = append(path, PathElement{Kind: PathCall, Key: string(name[s:i]), Args: string(bytes.TrimSpace(bracketContent(name, i, e, ')')))})
+			i = e
+			continue
+		}
+		path = append(path, PathElement{Kind: PathKey, Key: string(name[s:i])})
+	}
+	return root, path
+}
+
+// bracketElement converts the contents of square brackets into a path element
+func bracketElement(content []byte) PathElement {
+	l := len(content)
+	if l >= 2 && (content[0] == '\'' || content[0] == '"') && content[l-1] == content[0] {
+		if e, err := skipString(content, 0); err == nil && e == l {
+			return PathElement{Kind: PathKey, Key: string(unescapeString(content[1 : l-1]))}
+		}
+	}
+	if n, err := strconv.Atoi(string(content)); err == nil {
+		return PathElement{Kind: PathIndex, Index: n}
+	}
+	return PathElement{Kind: PathExpression, Key: string(content)}
+}
+
+// skipBracket skips a bracketed sequence starting at i taking nested brackets and strings into account.
+// Returns the position right after the closing bracket or the end of the input.
+func skipBracket(input []byte, i int, open, close byte) int {
+	l := len(input)
+	depth := 0
+	for i < l {
+		switch input[i] {
+		case '\'', '"':
+			e, err := skipString(input, i)
+			if err != nil {
+				return l
+			}
+			i = e
+			continue
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return l
+}
+
+// bracketContent returns the contents of brackets opened at s, e is the position right after the closing bracket
+// or the end of input if the bracket is not closed.
+func bracketContent(input []byte, s, e int, close byte) []byte {
+	if e-1 > s && input[e-1] == close {
+		return input[s+1 : e-1]
+	}
+	return input[s+1 : e]
+}
@@ -0,0 +1,293 @@
+package xpression
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Program is a compiled expression which can be evaluated multiple times.
+// A Program stores intermediate results in its tokens and is therefore not safe for concurrent use.
+type Program struct {
+	env        *Env
+	source     []byte
+	tokens     []*Token
+	variables  []VarRef
+	varIndex   map[*Token]int // index in variables for each variable token including the nested ones
+	parameters []Parameter
+}
+
+// VarRef is a reference to a variable used in an expression.
+type VarRef struct {
+	Name string        // the variable as written in the expression, exactly as passed to VariableFunc
+	Root string        // `$`, `@` or empty for bare names
+	Path []PathElement // structured path following the root
+	Pos  Position      // start of the first occurrence
+	End  Position      // end of the first occurrence
+}
+
+// Compile parses the expression into a Program using DefaultLimits.
+func Compile(expression []byte) (*Program, error) {
+	tokens, err := Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	return newProgram(defaultEnv(), expression, tokens), nil
+}
+
+func newProgram(env *Env, expression []byte, tokens []*Token) *Program {
+	source := make([]byte, len(expression))
+	copy(source, expression)
+	p := &Program{env: env, source: source, tokens: tokens, variables: variables(tokens), parameters: parameters(tokens)}
+	index := make(map[string]int, len(p.variables))
+	for i, ref := range p.variables {
+		index[ref.Name] = i
+	}
+	vars := collectVariables(tokens, nil)
+	p.varIndex = make(map[*Token]int, len(vars))
+	for _, tok := range vars {
+		p.varIndex[tok] = index[string(tok.Str)]
+	}
+	return p
+}
+
+// Variables returns distinct variables referenced by the expression in the order of their first use.
+func Variables(expression []byte) ([]VarRef, error) {
+	tokens, err := Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	return variables(tokens), nil
+}
+
+// variables collects distinct variables from tokens ordering them by position.
+func variables(tokens []*Token) []VarRef {
+	vars := collectVariables(tokens, make([]*Token, 0))
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].Pos.Offset < vars[j].Pos.Offset })
+
+	refs := make([]VarRef, 0, len(vars))
+	seen := make(map[string]bool)
+	for _, tok := range vars {
+		name := string(tok.Str)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		root, path := parsePath(tok.Str)
+		refs = append(refs, VarRef{Name: name, Root: root, Path: path, Pos: tok.Pos, End: tok.End})
+	}
+	return refs
+}
+
+// collectVariables appends variable tokens including the ones used in function arguments and let expressions.
+func collectVariables(tokens []*Token, vars []*Token) []*Token {
+	for _, tok := range tokens {
+		if tok.Category == tcVariable {
+			vars = append(vars, tok)
+		}
+		for _, sub := range tok.subexpressions() {
+			vars = collectVariables(sub, vars)
+		}
+	}
+	return vars
+}
+
+// Comments returns the comments of the program in the order of appearance.
+func (p *Program) Comments() []Comment {
+	comments := collectComments(p.tokens, nil)
+	sort.SliceStable(comments, func(i, j int) bool { return comments[i].Pos.Offset < comments[j].Pos.Offset })
+	return comments
+}
+
+// collectComments appends comments of the tokens including the ones used in function arguments and let expressions.
+func collectComments(tokens []*Token, comments []Comment) []Comment {
+	for _, tok := range tokens {
+		comments = append(comments, tok.Comments...)
+		for _, sub := range tok.subexpressions() {
+			comments = collectComments(sub, comments)
+		}
+	}
+	return comments
+}
+
+// Source returns the source of the expression.
+func (p *Program) Source() string {
+	return string(p.source)
+}
+
+// Tokens returns the parsed expression in prefix notation (NPN).
+func (p *Program) Tokens() []*Token {
+	return p.tokens
+}
+
+// Variables returns distinct variables referenced by the program in the order of their first use.
+func (p *Program) Variables() []VarRef {
+	return p.variables
+}
+
+// Eval evaluates the program using the limits of its Env (DefaultLimits unless compiled by Env.Compile).
+// External variables can be used via varFunc.
+func (p *Program) Eval(varFunc VariableFunc) (*Operand, error) {
+	return p.EvalContext(context.Background(), varFunc, p.env.limits())
+}
+
+// EvalContext evaluates the program honoring ctx cancellation and the evaluation limits.
+func (p *Program) EvalContext(ctx context.Context, varFunc VariableFunc, limits Limits) (*Operand, error) {
+	result, err := p.EvalShared(ctx, varFunc, limits)
+	if err != nil {
+		return nil, err
+	}
+	return result.Clone(), nil
+}
+
+// EvalShared is a zero-copy variant of EvalContext: the result points into the program and is overwritten
+// by the next evaluation. See EvaluateShared.
+func (p *Program) EvalShared(ctx context.Context, varFunc VariableFunc, limits Limits) (*Operand, error) {
+	ev := p.evaluator(ctx, nil, limits)
+	if varFunc != nil {
+		ev.resolver = varFunc
+	}
+	result, err := ev.evaluate(p.tokens)
+	return result, withSource(err, p.source)
+}
+
+func (p *Program) evaluator(ctx context.Context, resolver Resolver, limits Limits) evaluator {
+	if r, ok := resolver.(ContextResolver); ok {
+		resolver = r.WithContext(ctx, limits)
+	}
+	return evaluator{ctx: ctx, done: ctx.Done(), resolver: resolver, limits: limits, numeric: p.env.Numeric}
+}
+
+// EvalResolver evaluates the program resolving each distinct variable at most once, no matter how many times
+// it is referenced. If the resolver implements BatchResolver, all the variables are resolved up front in a single call.
+func (p *Program) EvalResolver(ctx context.Context, resolver Resolver, limits Limits) (*Operand, error) {
+	ev := p.evaluator(ctx, resolver, limits)
+	ev.varIndex = p.varIndex
+	ev.values = make([]Operand, len(p.variables))
+	ev.resolved = make([]bool, len(p.variables))
+	if batch, ok := ev.resolver.(BatchResolver); ok && len(p.variables) > 0 {
+		if err := batch.ResolveBatch(p.variables, ev.values); err != nil {
+			return nil, withSource(&EvalError{Err: err}, p.source)
+		}
+		for i := range ev.resolved {
+			ev.resolved[i] = true
+		}
+	}
+	result, err := ev.evaluate(p.tokens)
+	if err != nil {
+		return nil, withSource(err, p.source)
+	}
+	return result.Clone(), nil
+}
+
+// Value returns the value of a program consisting of a single literal, e.g. a result of PartialEval
+// with all the variables known.
+func (p *Program) Value() (*Operand, bool) {
+	if len(p.tokens) != 1 || p.tokens[0].Category != tcLiteral {
+		return nil, false
+	}
+	return p.tokens[0].Operand.Clone(), true
+}
+
+// String renders the program back to an expression adding parentheses only where needed.
+// Comments are kept next to the tokens they are attached to; a line comment is followed by a line break.
+func (p *Program) String() string {
+	return strings.TrimRight(render(p.tokens, p.env), "\n")
+}
+
+func render(tokens []*Token, env *Env) string {
+	type node struct {
+		text       string
+		precedence int
+	}
+	const operandPrecedence = 100
+	stack := make([]node, 0, 16)
+	for i := len(tokens) - 1; i >= 0; i-- {
+		tok := tokens[i]
+		switch tok.Category {
+		case tcIntermediateResult:
+			continue
+		case tcFunction:
+			args := make([]string, len(tok.call.args))
+			for n, arg := range tok.call.args {
+				args[n] = render(arg, env)
+			}
+			stack = append(stack, node{withComments(tok.String()+"("+strings.Join(args, ", ")+")", tok.Comments), operandPrecedence})
+		case tcLet: // the body extends as far as possible, so a let is parenthesized unless it is the whole expression
+			bindings := make([]string, len(tok.let.bindings))
+			for n, b := range tok.let.bindings {
+				bindings[n] = b.name + " = " + render(b.tokens, env)
+			}
+			stack = append(stack, node{withComments("let "+strings.Join(bindings, ", ")+" in "+render(tok.let.body, env), tok.Comments), 0})
+		case tcOperator:
+			details := tok.detail()
+			spelling := tok.String()
+			text := withComments(spelling, tok.Comments)
+			if len(stack) < details.Arguments {
+				return "???"
+			}
+			left := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if details.Arguments == 1 {
+				if left.precedence < details.Precedence {
+					left.text = "(" + left.text + ")"
+				} else if left.text != "" && left.text[0] == spelling[len(spelling)-1] {
+					left.text = " " + left.text // `- -1`
+				}
+				if text != spelling && !strings.HasSuffix(text, "\n") {
+					text += " " // `- /* comment */ 1`
+				}
+				stack = append(stack, node{text + left.text, details.Precedence})
+				continue
+			}
+			right := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if left.precedence < details.Precedence || (left.precedence == details.Precedence && details.Associativity == aRight) {
+				left.text = "(" + left.text + ")"
+			}
+			if right.precedence < details.Precedence || (right.precedence == details.Precedence && details.Associativity == aLeft) {
+				right.text = "(" + right.text + ")"
+			}
+			stack = append(stack, node{left.text + " " + text + " " + right.text, details.Precedence})
+		case tcVariable:
+			text := tok.String()
+			if tok.spelling == nil {
+				text = escapeVar(tok.Str, env)
+			}
+			stack = append(stack, node{withComments(text, tok.Comments), operandPrecedence})
+		default:
+			stack = append(stack, node{withComments(tok.String(), tok.Comments), operandPrecedence})
+		}
+	}
+	if len(stack) != 1 {
+		return "???"
+	}
+	return stack[0].text
+}
+
+// withComments surrounds the text of a token with its leading and trailing comments.
+func withComments(text string, comments []Comment) string {
+	for n := len(comments) - 1; n >= 0; n-- {
+		if c := comments[n]; !c.Trailing {
+			if isLineComment(c) {
+				text = c.Text + "\n" + text
+			} else {
+				text = c.Text + " " + text
+			}
+		}
+	}
+	for _, c := range comments {
+		if c.Trailing {
+			text += " " + c.Text
+			if isLineComment(c) {
+				text += "\n"
+			}
+		}
+	}
+	return text
+}
+
+// isLineComment reports whether the comment extends to the end of the line.
+func isLineComment(c Comment) bool {
+	return strings.HasPrefix(c.Text, "//")
+}
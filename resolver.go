@@ -0,0 +1,46 @@
+package xpression
+
+import (
+	"context"
+)
+
+// Resolver resolves variables referenced in an expression: it receives a variable exactly as it is
+// written in the expression and stores its value into result. VariableFunc implements Resolver.
+type Resolver interface {
+	Resolve(name []byte, result *Operand) error
+}
+
+// BatchResolver is a Resolver able to resolve all the variables needed by an expression in a single call.
+// ResolveBatch receives distinct variables in the order of their first use and stores their values into
+// the corresponding elements of results.
+type BatchResolver interface {
+	Resolver
+	ResolveBatch(vars []VarRef, results []Operand) error
+}
+
+// ContextResolver is a Resolver evaluating expressions itself, e.g. the bracketed key in `@.a[$.i + 1]`.
+// WithContext returns a copy of the resolver evaluating them with the context and the limits of the evaluation
+// it is used in. Program methods call it before resolving the variables.
+type ContextResolver interface {
+	Resolver
+	WithContext(ctx context.Context, limits Limits) Resolver
+}
+
+// resolverContext holds the context and the limits of the evaluation a resolver is used in.
+type resolverContext struct {
+	ctx    context.Context // nil if the resolver is used outside of an evaluation
+	limits Limits
+}
+
+// eval evaluates a bracketed expression of a variable path.
+func (c resolverContext) eval(expression string, varFunc VariableFunc) (*Operand, error) {
+	if c.ctx == nil {
+		return EvalVar([]byte(expression), varFunc)
+	}
+	return EvalContext(c.ctx, []byte(expression), varFunc, c.limits)
+}
+
+// Resolve calls f(name, result).
+func (f VariableFunc) Resolve(name []byte, result *Operand) error {
+	return f(name, result)
+}
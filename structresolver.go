@@ -0,0 +1,359 @@
+package xpression
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// StructResolver resolves variables against Go values using reflection: structs, pointers, interfaces,
+// maps, slices and arrays are walked the same way JSONResolver walks decoded JSON.
+// Struct fields are named by the `xpr` tag, then by the `json` tag, then by the field name;
+// fields tagged with "-" and unexported fields are not accessible. Fields of embedded structs are promoted.
+// Zero-argument methods returning a value (and optionally an error) can be called as `@.user.FullName()`
+// if AllowMethods is set. Field lookup plans are cached per type.
+type StructResolver struct {
+	Root         any  // `$`
+	Current      any  // `@`, Root is used if nil
+	AllowMethods bool // allow calling methods
+
+	eval resolverContext
+}
+
+// NewStructResolver creates a resolver for the value where the root node is also the current one.
+func NewStructResolver(root any) *StructResolver {
+	return &StructResolver{Root: root}
+}
+
+// Resolve implements Resolver.
+func (r *StructResolver) Resolve(name []byte, result *Operand) error {
+	root, path := parsePath(name)
+	return r.resolve(root, path, result)
+}
+
+// WithContext implements ContextResolver.
+func (r *StructResolver) WithContext(ctx context.Context, limits Limits) Resolver {
+	copied := *r
+	copied.eval = resolverContext{ctx: ctx, limits: limits}
+	return &copied
+}
+
+// ResolveBatch implements BatchResolver reusing the paths parsed at compile time.
+func (r *StructResolver) ResolveBatch(vars []VarRef, results []Operand) error {
+	for i := range vars {
+		if err := r.resolve(vars[i].Root, vars[i].Path, &results[i]); err != nil {
+			return fmt.Errorf("%s: %w", vars[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *StructResolver) resolve(root string, path []PathElement, result *Operand) error {
+	node := reflect.ValueOf(r.Root)
+	if root != "$" && r.Current != nil {
+		node = reflect.ValueOf(r.Current)
+	}
+	for _, elem := range path {
+		var err error
+		switch elem.Kind {
+		case PathKey:
+			node = reflectMember(node, elem.Key)
+		case PathIndex:
+			node = reflectIndex(node, elem.Index)
+		case PathExpression:
+			key, err := r.eval.eval(elem.Key, r.Resolve)
+			if err != nil {
+				return err
+			}
+			if key.Type == otNumber {
+				node = reflectIndex(node, int(key.Number))
+			} else {
+				node = reflectMember(node, string(toString(key)))
+			}
+		case PathCall:
+			node, err = r.call(node, elem)
+			if err != nil {
+				return err
+			}
+		}
+		if !node.IsValid() {
+			result.SetUndefined()
+			return nil
+		}
+	}
+	return setReflectValue(result, node)
+}
+
+// call calls a zero-argument method or a built-in `length()`
+func (r *StructResolver) call(node reflect.Value, elem PathElement) (reflect.Value, error) {
+	if elem.Args != "" {
+		return reflect.Value{}, fmt.Errorf("%w: %s(%s)", ErrInvalidPath, elem.Key, elem.Args)
+	}
+	if r.AllowMethods && node.IsValid() {
+		plan := typePlanFor(node.Type())
+		name := elem.Key
+		index, found := plan.methods[name]
+		if !found {
+			index, found = plan.methods[upperFirst(name)]
+		}
+		if found {
+			if (node.Kind() == reflect.Pointer || node.Kind() == reflect.Interface) && node.IsNil() {
+				return reflect.Value{}, nil
+			}
+			out := node.Method(index).Call(nil)
+			if len(out) == 2 && !out[1].IsNil() {
+				return reflect.Value{}, out[1].Interface().(error)
+			}
+			return out[0], nil
+		}
+	}
+	if elem.Key == "length" {
+		return reflectMember(node, elem.Key), nil
+	}
+	return reflect.Value{}, fmt.Errorf("%w: %s()", ErrInvalidPath, elem.Key)
+}
+
+// reflectMember returns a struct field, a map value or a `length` of a slice, an array, a map or a string.
+// Returns an invalid value if there is no such member.
+func reflectMember(node reflect.Value, key string) reflect.Value {
+	if custom, ok := customValue(node); ok {
+		value, found := customMember(custom, key)
+		if !found {
+			return reflect.Value{}
+		}
+		return reflect.ValueOf(value)
+	}
+	node = indirect(node)
+	switch node.Kind() {
+	case reflect.Struct:
+		index, found := typePlanFor(node.Type()).fields[key]
+		if !found {
+			return reflect.Value{}
+		}
+		field, err := node.FieldByIndexErr(index)
+		if err != nil { // nil embedded pointer
+			return reflect.Value{}
+		}
+		return field
+	case reflect.Map:
+		keyType := node.Type().Key()
+		var mapKey reflect.Value
+		switch keyType.Kind() {
+		case reflect.String:
+			mapKey = reflect.ValueOf(key).Convert(keyType)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(key, 10, 64)
+			if err != nil {
+				return reflect.Value{}
+			}
+			mapKey = reflect.ValueOf(n).Convert(keyType)
+		default:
+			return reflect.Value{}
+		}
+		return node.MapIndex(mapKey)
+	case reflect.Slice, reflect.Array:
+		if key == "length" {
+			return reflect.ValueOf(node.Len())
+		}
+		if n, err := strconv.Atoi(key); err == nil {
+			return reflectIndex(node, n)
+		}
+	case reflect.String:
+		if key == "length" {
+			return reflect.ValueOf(utf8.RuneCountInString(node.String()))
+		}
+	}
+	return reflect.Value{}
+}
+
+// reflectIndex returns an element of a slice or an array or a character of a string.
+// Negative index counts from the end.
+func reflectIndex(node reflect.Value, n int) reflect.Value {
+	if _, ok := customValue(node); ok {
+		return reflectMember(node, strconv.Itoa(n))
+	}
+	node = indirect(node)
+	switch node.Kind() {
+	case reflect.Slice, reflect.Array:
+		if n < 0 {
+			n += node.Len()
+		}
+		if n >= 0 && n < node.Len() {
+			return node.Index(n)
+		}
+	case reflect.Map:
+		return reflectMember(node, strconv.Itoa(n))
+	case reflect.String:
+		runes := []rune(node.String())
+		if n < 0 {
+			n += len(runes)
+		}
+		if n >= 0 && n < len(runes) {
+			return reflect.ValueOf(string(runes[n]))
+		}
+	}
+	return reflect.Value{}
+}
+
+// customValue returns the value as CustomValue if it implements the interface.
+func customValue(node reflect.Value) (CustomValue, bool) {
+	if !node.IsValid() || !node.CanInterface() {
+		return nil, false
+	}
+	if node.Kind() == reflect.Interface {
+		if node.IsNil() {
+			return nil, false
+		}
+		node = node.Elem()
+	}
+	if !node.Type().Implements(customValueType) {
+		return nil, false
+	}
+	if node.Kind() == reflect.Pointer && node.IsNil() {
+		return nil, false
+	}
+	return node.Interface().(CustomValue), true
+}
+
+// indirect dereferences pointers and interfaces
+func indirect(node reflect.Value) reflect.Value {
+	for node.IsValid() && (node.Kind() == reflect.Pointer || node.Kind() == reflect.Interface) {
+		if node.IsNil() {
+			return reflect.Value{}
+		}
+		node = node.Elem()
+	}
+	return node
+}
+
+// setReflectValue stores a Go value into the operand. Nil pointers, interfaces, maps and slices are stored as null,
+// other maps, slices, arrays and structs are stored as objects.
+func setReflectValue(result *Operand, value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		if value.IsNil() {
+			result.SetNull()
+			return nil
+		}
+	}
+	if custom, ok := customValue(value); ok {
+		result.SetCustom(custom)
+		return nil
+	}
+	if value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		return setReflectValue(result, indirect(value))
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		result.SetBoolean(value.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		result.SetNumber(float64(value.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		result.SetNumber(float64(value.Uint()))
+	case reflect.Float32, reflect.Float64:
+		result.SetNumber(value.Float())
+	case reflect.String:
+		result.SetString(value.String())
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		if !value.CanInterface() {
+			return fmt.Errorf("%w: %s", ErrUnsupportedValue, value.Type())
+		}
+		result.SetObject(value.Interface())
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedValue, value.Type())
+	}
+	return nil
+}
+
+// typePlan describes how to access members of a type
+type typePlan struct {
+	fields  map[string][]int // struct field index by name
+	methods map[string]int   // index of zero-argument methods returning a value (and optionally an error)
+}
+
+var typePlans sync.Map // reflect.Type -> *typePlan
+
+func typePlanFor(t reflect.Type) *typePlan {
+	if plan, found := typePlans.Load(t); found {
+		return plan.(*typePlan)
+	}
+	plan := &typePlan{fields: make(map[string][]int), methods: make(map[string]int)}
+	if t.Kind() == reflect.Struct {
+		collectFields(t, nil, plan.fields, make(map[reflect.Type]bool))
+	}
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	for i := 0; i < t.NumMethod(); i++ {
+		method := t.Method(i)
+		mt := method.Type
+		in := 1 // receiver
+		if t.Kind() == reflect.Interface {
+			in = 0
+		}
+		if mt.NumIn() != in || mt.NumOut() < 1 || mt.NumOut() > 2 || (mt.NumOut() == 2 && mt.Out(1) != errorType) {
+			continue
+		}
+		plan.methods[method.Name] = i
+	}
+	actual, _ := typePlans.LoadOrStore(t, plan)
+	return actual.(*typePlan)
+}
+
+// collectFields collects exported fields of a struct including promoted fields of embedded structs.
+// Fields of the outer struct take precedence over the promoted ones.
+func collectFields(t reflect.Type, index []int, fields map[string][]int, visited map[reflect.Type]bool) {
+	visited[t] = true
+	embedded := make([]reflect.StructField, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, tagged := fieldName(field)
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && !tagged {
+			embedded = append(embedded, field)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if _, found := fields[name]; !found {
+			fields[name] = append(append([]int{}, index...), i)
+		}
+	}
+	for _, field := range embedded {
+		ft := field.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && !visited[ft] {
+			collectFields(ft, append(append([]int{}, index...), field.Index...), fields, visited)
+		} else if field.IsExported() {
+			if _, found := fields[field.Name]; !found {
+				fields[field.Name] = append(append([]int{}, index...), field.Index...)
+			}
+		}
+	}
+}
+
+// fieldName returns the name of a struct field defined by `xpr` or `json` tag or the field name itself.
+func fieldName(field reflect.StructField) (string, bool) {
+	for _, tag := range []string{"xpr", "json"} {
+		if value, found := field.Tag.Lookup(tag); found {
+			name := strings.Split(value, ",")[0]
+			if name != "" {
+				return name, true
+			}
+		}
+	}
+	return field.Name, false
+}
+
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
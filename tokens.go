@@ -1,8 +1,13 @@
 package xpression
 
 import (
+	"bytes"
+	"math"
 	"regexp"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 func SetLiteral(tok *Token) {
@@ -38,25 +43,236 @@ func readString(path []byte, i int) (int, *Token, error) {
 	if err != nil {
 		return i, nil, err
 	}
-	return e, &Token{Category: tcLiteral, Operand: Operand{Type: otString, Str: path[i+1 : e-1]}}, nil
+	return e, &Token{Category: tcLiteral, Operand: Operand{Type: otString, Str: cloneBytes(unescapeString(path[i+1 : e-1]))}}, nil
 }
 
-func readBoolNull(path []byte, i int) (int, *Token, error) {
-	needles := [...][]byte{[]byte("false"), []byte("true"), []byte("null")}
-	for n := 0; n < len(needles); n++ {
-		if matchSubslice(path[i:], needles[n]) {
-			if n == 2 {
-				return i + len(needles[n]), &Token{Category: tcLiteral, Operand: Operand{Type: otNull}}, nil
-			} else {
-				return i + len(needles[n]), &Token{Category: tcLiteral, Operand: Operand{Type: otBoolean, Bool: n > 0}}, nil
+// unescapeString decodes JavaScript escape sequences: \n, \t, \xHH, \uHHHH, \u{H...} etc.
+// A backslash followed by any other character is dropped. Returns the input as is if there are no escapes.
+func unescapeString(input []byte) []byte {
+	if bytes.IndexByte(input, '\\') < 0 {
+		return input
+	}
+	result := make([]byte, 0, len(input))
+	for i := 0; i < len(input); i++ {
+		if input[i] != '\\' || i+1 == len(input) {
+			result = append(result, input[i])
+			continue
+		}
+		i++
+		switch c := input[i]; c {
+		case 'n':
+			result = append(result, '\n')
+		case 't':
+			result = append(result, '\t')
+		case 'r':
+			result = append(result, '\r')
+		case 'b':
+			result = append(result, '\b')
+		case 'f':
+			result = append(result, '\f')
+		case 'v':
+			result = append(result, '\v')
+		case '0':
+			result = append(result, 0)
+		case '\n': // line continuation
+		case 'x', 'u':
+			r, n := hexEscape(input[i+1:], c)
+			if n == 0 {
+				result = append(result, c)
+				break
 			}
+			result = utf8.AppendRune(result, r)
+			i += n
+		default:
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// hexEscape decodes the hexadecimal part of \xHH, \uHHHH or \u{H...} escape.
+// Returns the rune and the number of bytes consumed, 0 if the escape is malformed.
+func hexEscape(input []byte, kind byte) (rune, int) {
+	digits, skip := 2, 0
+	if kind == 'u' {
+		digits = 4
+		if len(input) > 0 && input[0] == '{' {
+			end := bytes.IndexByte(input, '}')
+			if end < 2 {
+				return 0, 0
+			}
+			digits, skip = end-1, 1
+		}
+	}
+	if len(input) < skip+digits {
+		return 0, 0
+	}
+	r, err := strconv.ParseUint(string(input[skip:skip+digits]), 16, 32)
+	if err != nil || r > unicode.MaxRune {
+		return 0, 0
+	}
+	return rune(r), skip*2 + digits
+}
+
+// keywordLiterals are the reserved words read as literals.
+var keywordLiterals = []struct {
+	Spelling []byte
+	Operand  Operand
+}{
+	{[]byte("false"), Operand{Type: otBoolean}},
+	{[]byte("true"), Operand{Type: otBoolean, Bool: true}},
+	{[]byte("null"), Operand{Type: otNull}},
+	{[]byte("undefined"), Operand{Type: otUndefined}},
+	{[]byte("NaN"), Operand{Type: otNumber, Number: math.NaN()}},
+	{[]byte("Infinity"), Operand{Type: otNumber, Number: math.Inf(1)}},
+}
+
+// readKeywordLiteral reads `true`, `false`, `null`, `undefined`, `NaN` or `Infinity` at an identifier boundary:
+// `nullable` or `trueValue` are variables.
+func readKeywordLiteral(path []byte, i int) (int, *Token, error) {
+	for _, kw := range keywordLiterals {
+		if matchKeyword(path[i:], kw.Spelling) {
+			return i + len(kw.Spelling), &Token{Category: tcLiteral, Operand: kw.Operand}, nil
+		}
+	}
+	return i, nil, ErrUnknownToken
+}
+
+// readEscapedVar reads a variable name escaped with backticks: `true`, `and`, `order total`.
+// The backticks are not a part of the name, which may continue with a path: `null`.length is "null.length".
+func readEscapedVar(path []byte, i int, bound []byte) (int, *Token, error) {
+	e := bytes.IndexByte(path[i+1:], '`')
+	if e < 0 {
+		return i, nil, ErrUnexpectedEndOfString
+	}
+	if e == 0 {
+		return i, nil, ErrUnknownToken
+	}
+	name := cloneBytes(path[i+1 : i+1+e])
+	i += e + 2
+	if i < len(path) && (path[i] == '.' || path[i] == '[') {
+		var tok *Token
+		var err error
+		if i, tok, err = readVar(path, i, bound); err != nil {
+			return i, nil, err
 		}
+		name = append(name, tok.Str...)
 	}
-	return i, nil, errUnknownToken
+	return i, &Token{Category: tcVariable, Operand: Operand{Type: otVariable, Str: name}}, nil
 }
 
-func readRegexp(path []byte, i int) (int, *Token, error) {
+// isReserved reports whether the word is a keyword literal or a keyword operator.
+func isReserved(word []byte) bool {
+	for _, kw := range keywordLiterals {
+		if bytes.Equal(word, kw.Spelling) {
+			return true
+		}
+	}
+	for _, kw := range operatorKeywords {
+		if bytes.Equal(word, kw.Spelling) {
+			return true
+		}
+	}
+	return string(word) == "is" || string(word) == "in"
+}
+
+// reserved reports whether the word is read as a keyword in the environment: a keyword literal, `in` or,
+// with KeywordOperators, a keyword operator.
+func (e *Env) reserved(word []byte) bool {
+	if e.KeywordOperators {
+		return isReserved(word)
+	}
+	for _, kw := range keywordLiterals {
+		if bytes.Equal(word, kw.Spelling) {
+			return true
+		}
+	}
+	return string(word) == "in"
+}
+
+// escapeVar escapes a variable name with backticks unless readVar reads it back unchanged: `null`.length,
+// `order total`, `a b`.c. Only the first segment of the name is escaped if the rest can be read as is.
+func escapeVar(name []byte, env *Env) string {
+	if readsBack(name, env) {
+		return string(name)
+	}
+	if bytes.IndexByte(name, '`') >= 0 {
+		return string(name) // can not be escaped
+	}
+	if k := bytes.IndexAny(name[1:], ".["); k >= 0 {
+		if e, _, err := readVar(name, k+1, env.bound); err == nil && e == len(name) {
+			return "`" + string(name[:k+1]) + "`" + string(name[k+1:])
+		}
+	}
+	return "`" + string(name) + "`"
+}
+
+// readsBack reports whether the name is read back in the environment as a single variable without escaping.
+func readsBack(name []byte, env *Env) bool {
+	if len(name) == 0 {
+		return false
+	}
+	i := identifierEnd(name, 0)
+	if i == 0 && strings.IndexByte(env.VariableStart, name[0]) < 0 {
+		return false
+	}
+	if i > 0 && env.reserved(name[:i]) {
+		return false
+	}
+	if name[0] == '$' && len(name) > 1 && name[1] >= '0' && name[1] <= '9' { // read as a numbered parameter
+		return false
+	}
+	e, _, err := readVar(name, 0, env.bound)
+	return err == nil && e == len(name)
+}
+
+// readKeyword reads a keyword operator at i returning its length and code, 0 if there is none.
+// `is` followed by `null` and `is not` followed by `null` are read as `==` and `!=` leaving `null`
+// to be read as a literal: `@.a is not null` is `@.a != null`.
+func readKeyword(path []byte, i int) (int, Operator) {
+	for _, kw := range operatorKeywords {
+		if matchKeyword(path[i:], kw.Spelling) {
+			return len(kw.Spelling), kw.Code
+		}
+	}
+	if !matchKeyword(path[i:], []byte("is")) {
+		return 0, opNone
+	}
+	code := opEqual
+	j := skipBlanks(path, i+2)
+	if matchKeyword(path[j:], []byte("not")) {
+		code = opNotEqual
+		j = skipBlanks(path, j+3)
+	}
+	if j == i+2 || !matchKeyword(path[j:], []byte("null")) {
+		return 0, opNone
+	}
+	return j - i, code
+}
+
+// matchKeyword reports whether input starts with the keyword followed by a non-identifier character.
+func matchKeyword(input, keyword []byte) bool {
+	if !matchSubslice(input, keyword) {
+		return false
+	}
+	if len(input) == len(keyword) {
+		return true
+	}
+	r, _ := utf8.DecodeRune(input[len(keyword):])
+	return !isIdentContinue(r) && r != '.'
+}
+
+// skipBlanks skips whitespace without commas.
+func skipBlanks(input []byte, i int) int {
+	for i < len(input) && bytein(input[i], []byte{' ', '\t', '\r', '\n'}) {
+		i++
+	}
+	return i
+}
+
+func readRegexp(path []byte, i int, accepted string) (int, *Token, error) {
 	l := len(path)
+	s := i
 	prev := byte(0)
 	re := make([]byte, 0, 32)
 	flags := make([]byte, 0, 8)
@@ -70,7 +286,7 @@ func readRegexp(path []byte, i int) (int, *Token, error) {
 		i++
 	}
 	flags = append(flags, '(', '?')
-	for i < l && len(flags) < 4 && (path[i] == 'i' || path[i] == 'm' || path[i] == 's' || path[i] == 'U') {
+	for i < l && len(flags) < 4 && strings.IndexByte(accepted, path[i]) >= 0 {
 		flags = append(flags, path[i])
 		i++
 	}
@@ -83,7 +299,7 @@ func readRegexp(path []byte, i int) (int, *Token, error) {
 	}
 	reg, err := regexp.Compile(rex)
 	if err != nil {
-		return i, nil, err
+		return s, nil, err
 	}
 	return i, &Token{Category: tcLiteral, Operand: Operand{Type: otRegexp, Regexp: reg}}, nil
 }
@@ -93,7 +309,7 @@ func readHex(input []byte) (float64, error) {
 	nibble := 0
 	for _, b := range input {
 		if nibble > 15 {
-			return 0, errTooLongHexadecimal
+			return 0, ErrTooLongHexadecimal
 		}
 		add := byte(0)
 		if b >= '0' && b <= '9' {
@@ -113,14 +329,14 @@ func readHex(input []byte) (float64, error) {
 	return float64(signed), nil
 }
 
-// readVar reads variable matching the following "regex": ([^operatorBound]+(\[[^\[]+]\])*)+
+// readVar reads variable matching the following "regex": ([^bound]+(\[[^\[]+]\])*)+
 // which means:
-// 1) a string not containing operatorBound symbols;
+// 1) a string not containing bound symbols (first characters of operators);
 // 2) followed by optional sequence of one or more square brackets with any symbols between them;
 // 3) possibly repeated again starting from 1;
-// The variable can start with the following characters: a-z, A-Z, $, @.
+// The variable can start with a Unicode letter, an underscore or a character of Env.VariableStart ($, @ by default).
 // Examples of valid variables: "@var", "@.var", "var", "var[1]", "@[1]", "var['foo']", "var[1+2]"
-func readVar(path []byte, i int) (int, *Token, error) {
+func readVar(path []byte, i int, bound []byte) (int, *Token, error) {
 	var err error
 	l := len(path)
 	s := i
@@ -128,7 +344,7 @@ func readVar(path []byte, i int) (int, *Token, error) {
 	openBracket := 0
 	for !done {
 		done = true
-		for i < l && !bytein(path[i], operatorBound) {
+		for i < l && (!bytein(path[i], bound) || (openBracket > 0 && path[i] == ',')) {
 			// "function" patch: we accept `var()` or even `var(fn())` as a variable,
 			// but assume a non-paired closing bracket as a variable bound: `var)` results in `var`.
 			if path[i] == '(' {
@@ -156,12 +372,12 @@ func readVar(path []byte, i int) (int, *Token, error) {
 					return i, nil, err
 				}
 			}
-			if path[i] == ']' {
+			if i < l && path[i] == ']' {
 				i++
 			}
 		}
 	}
-	return i, &Token{Category: tcVariable, Operand: Operand{Type: otVariable, Str: path[s:i]}}, nil
+	return i, &Token{Category: tcVariable, Operand: Operand{Type: otVariable, Str: cloneBytes(path[s:i])}}, nil
 }
 
 func skipVarChar(path []byte, i int) (int, error) {
@@ -214,7 +430,7 @@ func skipHex(input []byte, i int) (int, int, error) {
 	for ; i < len(input); i++ {
 		if !((input[i] >= '0' && input[i] <= '9') || (input[i] >= 'a' && input[i] <= 'f') || (input[i] >= 'A' && input[i] <= 'F')) {
 			if (input[i] > 'F' && input[i] <= 'Z') || (input[i] > 'f' && input[i] <= 'z') {
-				return start, numHex, errInvalidHexadecimal
+				return start, numHex, ErrInvalidHexadecimal
 			}
 			break
 		}
@@ -238,7 +454,7 @@ func skipString(input []byte, i int) (int, error) {
 		i++
 	}
 	if i == l && !done {
-		return s, errUnexpectedEndOfString
+		return s, ErrUnexpectedEndOfString
 	}
 	return i, nil
 }
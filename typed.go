@@ -0,0 +1,181 @@
+package xpression
+
+import (
+	"context"
+)
+
+// Scalar lists Go types an expression result can be converted to.
+type Scalar interface {
+	bool | float64 | int | string
+}
+
+// TypedProgram is a compiled expression whose result can be converted to T.
+type TypedProgram[T Scalar] struct {
+	*Program
+}
+
+// anyType is a set of all the types a variable can be resolved to
+const anyType = otString | otNumber | otBoolean | otNull | otUndefined | otRegexp | otObject | otCustom
+
+// CompileAs compiles the expression and checks that its result can be converted to T following JavaScript rules.
+// Any value converts to a boolean or a string, while undefined and a regexp never convert to a number:
+// `/a+/` can not be compiled as float64, `@.a > 1` converts to 0 or 1. Returns a *TypeError if the type is incompatible.
+func CompileAs[T Scalar](expression []byte) (*TypedProgram[T], error) {
+	program, err := Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	want, name := scalarType[T]()
+	if produced := resultType(program.tokens); produced&want == 0 {
+		return nil, &TypeError{From: produced, To: name}
+	}
+	return &TypedProgram[T]{program}, nil
+}
+
+// Eval evaluates the program using the limits of its Env (DefaultLimits unless compiled by Env.Compile)
+// and converts the result to T following JavaScript rules.
+func (p *TypedProgram[T]) Eval(varFunc VariableFunc) (T, error) {
+	return p.EvalContext(context.Background(), varFunc, p.env.limits())
+}
+
+// EvalContext evaluates the program honoring ctx cancellation and the evaluation limits
+// and converts the result to T following JavaScript rules.
+func (p *TypedProgram[T]) EvalContext(ctx context.Context, varFunc VariableFunc, limits Limits) (T, error) {
+	result, err := p.Program.EvalShared(ctx, varFunc, limits) // the result is converted right away
+	return convertResult[T](result, err)
+}
+
+// EvalResolver evaluates the program with memoized variables (see Program.EvalResolver)
+// and converts the result to T following JavaScript rules.
+func (p *TypedProgram[T]) EvalResolver(ctx context.Context, resolver Resolver, limits Limits) (T, error) {
+	result, err := p.Program.EvalResolver(ctx, resolver, limits)
+	return convertResult[T](result, err)
+}
+
+// EvalAs evaluates the expression and converts the result to T. See CompileAs.
+func EvalAs[T Scalar](expression []byte, varFunc VariableFunc) (T, error) {
+	program, err := CompileAs[T](expression)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return program.Eval(varFunc)
+}
+
+// EvalBool evaluates the expression and converts the result to boolean. See CompileAs.
+func EvalBool(expression []byte, varFunc VariableFunc) (bool, error) {
+	return EvalAs[bool](expression, varFunc)
+}
+
+// EvalFloat evaluates the expression and converts the result to number. See CompileAs.
+func EvalFloat(expression []byte, varFunc VariableFunc) (float64, error) {
+	return EvalAs[float64](expression, varFunc)
+}
+
+// EvalString evaluates the expression and converts the result to string. See CompileAs.
+func EvalString(expression []byte, varFunc VariableFunc) (string, error) {
+	return EvalAs[string](expression, varFunc)
+}
+
+func convertResult[T Scalar](result *Operand, err error) (T, error) {
+	var value T
+	if err != nil {
+		return value, err
+	}
+	switch v := any(&value).(type) {
+	case *bool:
+		*v = result.AsBool()
+	case *float64:
+		*v = result.AsFloat()
+	case *int:
+		*v = result.AsInt()
+	case *string:
+		*v = result.AsString()
+	}
+	return value, nil
+}
+
+// scalarType returns the set of operand types converted to T and the name of T.
+func scalarType[T Scalar]() (OperandType, string) {
+	const numeric = anyType &^ (otUndefined | otRegexp) // undefined and regexp are converted to NaN
+	var value T
+	switch any(value).(type) {
+	case bool:
+		return anyType, "bool"
+	case float64:
+		return numeric, "float64"
+	case int:
+		return numeric, "int"
+	}
+	return anyType, "string"
+}
+
+// resultType returns the set of types the expression can produce.
+func resultType(tokens []*Token) OperandType {
+	stack := make([]OperandType, 0, 16)
+	for i := len(tokens) - 1; i >= 0; i-- {
+		tok := tokens[i]
+		switch tok.Category {
+		case tcLiteral:
+			stack = append(stack, tok.Type)
+		case tcVariable, tcInvalid, tcFunction, tcLet, tcBinding:
+			stack = append(stack, anyType)
+		case tcParameter:
+			if tok.Type != 0 { // type hint
+				stack = append(stack, tok.Type)
+			} else {
+				stack = append(stack, anyType)
+			}
+		case tcOperator:
+			var left, right OperandType
+			n := len(stack)
+			if tok.detail().Arguments > 1 {
+				if n < 2 {
+					return anyType
+				}
+				left, right, stack = stack[n-1], stack[n-2], stack[:n-2]
+			} else {
+				if n < 1 {
+					return anyType
+				}
+				left, stack = stack[n-1], stack[:n-1]
+			}
+			if tok.def != nil { // user-registered or overloaded operator can produce anything
+				stack = append(stack, anyType)
+				continue
+			}
+			stack = append(stack, operatorType(tok.Operator, left, right))
+		}
+	}
+	if len(stack) != 1 {
+		return anyType
+	}
+	return stack[0]
+}
+
+// operatorType returns the set of types the operator can produce given the types of its operands.
+func operatorType(op Operator, left, right OperandType) OperandType {
+	const stringLike = otString | otObject // converted to string by `+`
+	switch op {
+	case opLogicalAND, opLogicalOR:
+		return left | right
+	case opEqual, opStrictEqual, opNotEqual, opStrictNotEqual, opG, opGE, opL, opLE,
+		opRegexMatch, opNotRegexMatch, opLogicalNOT, opLogicalXOR:
+		return otBoolean
+	case opPlus:
+		custom := (left | right) & otCustom
+		switch {
+		case left&^stringLike == 0 || right&^stringLike == 0:
+			return otString
+		case (left|right)&stringLike != 0:
+			return otString | otNumber | custom
+		}
+		return otNumber | custom
+	case opInvalid:
+		return anyType
+	}
+	if (left|right)&otCustom != 0 { // custom arithmetic is expected to produce a custom value or a number
+		return otNumber | otCustom
+	}
+	return otNumber
+}
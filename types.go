@@ -1,20 +1,21 @@
 package xpression
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
-	"strconv"
 )
 
-type Operator byte      // list of operators: + - * / < > == !=
-type TokenCategory byte // operator, literal (operand), parentheses
-type OperandType byte   // string, number, boolean, null, undefined
-type Associativity byte // left, right
+type Operator byte        // list of operators: + - * / < > == !=
+type TokenCategory uint16 // operator, literal (operand), parentheses
+type OperandType uint16   // string, number, boolean, null, undefined, object, custom: otCustom does not fit in a byte
+type Associativity byte   // left, right
 
 const (
 	opNone             Operator = '\x00'
 	opLogicalOR        Operator = 'O'
 	opLogicalAND       Operator = 'A'
+	opLogicalXOR       Operator = 'X' // keyword dialect only, see Env.KeywordOperators
 	opBitwiseOR        Operator = '|'
 	opBitwiseXOR       Operator = '^'
 	opBitwiseAND       Operator = '&'
@@ -41,6 +42,8 @@ const (
 	opUnaryMinus       Operator = '_'
 	opLeftParenthesis  Operator = '('
 	opRightParenthesis Operator = ')'
+	opInvalid          Operator = '#' // missing operator placeholder in a partial tree
+	opCustom           Operator = 'C' // user-registered operator, see Env
 )
 
 const (
@@ -50,6 +53,12 @@ const (
 	tcLeftParenthesis                              //
 	tcRightParenthesis                             //
 	tcVariable                                     // @.key etc
+	tcInvalid                                      // malformed literal or missing operand placeholder in a partial tree
+	tcUnknown                                      // unrecognized characters, never included in a tree
+	tcFunction                                     // call of a function registered in Env
+	tcParameter                                    // bind parameter: ?, $1, :name
+	tcLet                                          // let expression: let name = value, ... in body
+	tcBinding                                      // reference to a let binding
 )
 
 const (
@@ -60,6 +69,8 @@ const (
 	otUndefined
 	otRegexp
 	otVariable
+	otObject // map or slice, e.g. a part of decoded JSON
+	otCustom // CustomValue
 )
 
 const (
@@ -71,6 +82,8 @@ const (
 	UndefinedOperand = otUndefined
 	RegexpOperand    = otRegexp
 	VariableOperand  = otVariable
+	ObjectOperand    = otObject
+	CustomOperand    = otCustom
 )
 
 const (
@@ -117,8 +130,22 @@ var operatorSpelling = []struct {
 	{[]byte("-"), opUnaryMinus},
 }
 
+// operatorKeywords are the keyword spellings accepted by Env.KeywordOperators.
+// `is null` and `is not null` are read as `== null` and `!= null`, see readKeyword.
+var operatorKeywords = []struct {
+	Spelling []byte
+	Code     Operator
+}{
+	{[]byte("and"), opLogicalAND},
+	{[]byte("or"), opLogicalOR},
+	{[]byte("xor"), opLogicalXOR},
+	{[]byte("not"), opLogicalNOT},
+	{[]byte("matches"), opRegexMatch},
+}
+
 var operatorDetails = map[Operator]OperatorDetail{
 	opLogicalOR:        {aLeft, 1, 2},   // logical OR
+	opLogicalXOR:       {aLeft, 1, 2},   // logical XOR
 	opLogicalAND:       {aLeft, 2, 2},   // logical AND
 	opBitwiseOR:        {aLeft, 3, 2},   // bitwise OR
 	opBitwiseXOR:       {aLeft, 4, 2},   // bitwise XOR
@@ -141,11 +168,12 @@ var operatorDetails = map[Operator]OperatorDetail{
 	opDivide:           {aLeft, 10, 2},  // /
 	opRemainder:        {aLeft, 10, 2},  // %
 	opExponentiation:   {aRight, 11, 2}, // **
-	opLogicalNOT:       {aLeft, 12, 1},  // logical NOT (!)
-	opBitwiseNOT:       {aLeft, 12, 1},  // bitwise NOT (~)
-	opUnaryMinus:       {aLeft, 12, 1},  // unary -
+	opLogicalNOT:       {aRight, 12, 1}, // logical NOT (!)
+	opBitwiseNOT:       {aRight, 12, 1}, // bitwise NOT (~)
+	opUnaryMinus:       {aRight, 12, 1}, // unary -
 	opLeftParenthesis:  {aLeft, 13, 2},  // (
 	opRightParenthesis: {aLeft, 13, 2},  // )
+	opInvalid:          {aLeft, 0, 2},   // missing operator
 }
 
 type Operand struct {
@@ -154,18 +182,7 @@ type Operand struct {
 	Number float64
 	Bool   bool
 	Regexp *regexp.Regexp
-	// + node reference
-}
-
-var operatorBound []byte
-
-func init() {
-	operatorBound = []byte{' ', '['}
-	for _, operator := range operatorSpelling {
-		if !bytein(operator.Spelling[0], operatorBound) {
-			operatorBound = append(operatorBound, operator.Spelling[0])
-		}
-	}
+	Object any // map or slice
 }
 
 func (op *Operand) String() string {
@@ -175,13 +192,19 @@ func (op *Operand) String() string {
 	case otUndefined:
 		return "undefined"
 	case otString:
-		return fmt.Sprintf("\"%s\"", string(op.Str))
+		return string(quoteString(op.Str, false))
 	case otNumber:
-		return strconv.FormatFloat(op.Number, 'f', -1, 64)
+		return string(formatNumber(op.Number))
 	case otBoolean:
 		return fmt.Sprintf("%v", op.Bool)
 	case otRegexp:
-		return fmt.Sprintf("/%s/", op.Regexp.String())
+		return "/" + op.Regexp.String() + "/"
+	case otObject:
+		if buf, err := json.Marshal(op.Object); err == nil {
+			return string(buf)
+		}
+	case otCustom:
+		return string(customJSON(op.Object))
 	}
 	return "???"
 }
@@ -190,27 +213,72 @@ type Token struct {
 	Category TokenCategory
 	Operator Operator
 	Operand
+	Pos Position // start of the token in the expression source
+	End Position // end of the token (position right after its last character)
+
+	Comments []Comment // comments attached to the token
+
+	def  *operatorDef  // user-registered or overloaded operator
+	call *functionCall // function and arguments of a tcFunction token
+	let  *letExpr      // bindings and body of a tcLet token
+
+	spelling []byte // source of a variable read by Env.VariableSyntax or of a bind parameter
+	env      *Env   // environment a variable is read in, its name is escaped for this environment
 }
 
-func (tok *Token) String() string {
-	opCode := func(op Operator) string {
-		for _, rec := range operatorSpelling {
-			if rec.Code == op {
-				return string(rec.Spelling)
-			}
+// operatorString returns the spelling of the operator.
+func operatorString(op Operator) string {
+	for _, rec := range operatorSpelling {
+		if rec.Code == op {
+			return string(rec.Spelling)
+		}
+	}
+	for _, rec := range operatorKeywords {
+		if rec.Code == op {
+			return string(rec.Spelling)
 		}
-		return "???"
 	}
+	return "???"
+}
+
+// Comment is a `/* block */` or `// line` comment. Comments are trivia: they do not affect evaluation
+// but are kept in the tokens, so a formatter can restore them.
+// A comment is attached to the token following it unless it is on the same line as the preceding token
+// or at the end of the expression, then it is attached to the preceding token as a trailing one.
+type Comment struct {
+	Text     string // including the delimiters
+	Pos      Position
+	End      Position
+	Trailing bool // the comment follows the token
+}
 
+func (tok *Token) String() string {
 	switch tok.Category {
 	case tcIntermediateResult:
 		return "IR"
 	case tcLiteral:
 		return tok.Operand.String()
 	case tcOperator:
-		return opCode(tok.Operator)
+		if tok.def != nil {
+			return string(tok.def.spelling)
+		}
+		return operatorString(tok.Operator)
 	case tcVariable:
+		if tok.spelling != nil {
+			return string(tok.spelling)
+		}
+		if tok.env == nil { // made by hand
+			return escapeVar(tok.Str, defaultEnv())
+		}
+		return escapeVar(tok.Str, tok.env)
+	case tcParameter:
+		return string(tok.spelling)
+	case tcInvalid, tcUnknown, tcFunction, tcLet, tcBinding:
 		return string(tok.Str)
+	case tcLeftParenthesis:
+		return "("
+	case tcRightParenthesis:
+		return ")"
 	}
 
 	return "unknown"
@@ -244,6 +312,26 @@ func (op *Operand) SetRegexp(r *regexp.Regexp) {
 	op.Regexp = r
 }
 
+func (op *Operand) SetObject(v any) {
+	op.Type = otObject
+	op.Object = v
+}
+
+// Clone returns a copy of the operand which does not share the string buffer with the original.
+// Regexps and objects are shared as they are references.
+func (op *Operand) Clone() *Operand {
+	clone := *op
+	clone.Str = cloneBytes(op.Str)
+	return &clone
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
 func String(s string) *Operand {
 	return &Operand{Type: otString, Str: []byte(s)}
 }
@@ -267,3 +355,7 @@ func Undefined() *Operand {
 func Regexp(r *regexp.Regexp) *Operand {
 	return &Operand{Type: otRegexp, Regexp: r}
 }
+
+func Object(v any) *Operand {
+	return &Operand{Type: otObject, Object: v}
+}
@@ -0,0 +1,160 @@
+package xpression
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FromValue converts a Go value into an operand: nil becomes null, numeric kinds become numbers,
+// strings and byte slices become strings, other slices, arrays, maps and structs (including time.Time)
+// become objects, CustomValue implementations become custom operands.
+// Pointers and interfaces are dereferenced, nil pointers, slices and maps become null.
+func FromValue(value any) (*Operand, error) {
+	result := &Operand{}
+	switch v := value.(type) {
+	case nil:
+		result.SetNull()
+	case *Operand:
+		*result = *v
+	case Operand:
+		*result = v
+	case []byte:
+		result.Type = otString
+		result.Str = append([]byte{}, v...)
+	case *regexp.Regexp:
+		result.SetRegexp(v)
+	case json.Number:
+		if err := setJSONValue(result, v); err != nil {
+			return nil, err
+		}
+	default:
+		if err := setReflectValue(result, reflect.ValueOf(value)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Value returns the operand as a Go value: string, float64, bool, *regexp.Regexp, the object or custom value itself,
+// or nil for null and undefined.
+func (op *Operand) Value() any {
+	switch op.Type {
+	case otString:
+		return string(op.Str)
+	case otNumber:
+		return op.Number
+	case otBoolean:
+		return op.Bool
+	case otRegexp:
+		return op.Regexp
+	case otObject, otCustom:
+		return op.Object
+	}
+	return nil
+}
+
+// AsFloat converts the operand to a number following JavaScript rules.
+func (op *Operand) AsFloat() float64 { return toNumber(op) }
+
+// AsInt converts the operand to a number following JavaScript rules and truncates it.
+// NaN is converted to 0, values out of range are clamped.
+func (op *Operand) AsInt() int { return floatToInt(toNumber(op)) }
+
+// AsString converts the operand to a string following JavaScript rules.
+func (op *Operand) AsString() string { return string(toString(op)) }
+
+// AsBool converts the operand to a boolean following JavaScript rules.
+func (op *Operand) AsBool() bool { return toBoolean(op) }
+
+// AsFloatStrict returns the number or a *TypeError if the operand is not a number.
+func (op *Operand) AsFloatStrict() (float64, error) {
+	if op.Type != otNumber {
+		return 0, op.typeError("float64")
+	}
+	return op.Number, nil
+}
+
+// AsIntStrict returns the number or a *TypeError if the operand is not an integer number representable as int.
+func (op *Operand) AsIntStrict() (int, error) {
+	if op.Type != otNumber || op.Number != math.Trunc(op.Number) || op.Number < math.MinInt || op.Number >= math.MaxInt {
+		return 0, op.typeError("int")
+	}
+	return int(op.Number), nil
+}
+
+// AsStringStrict returns the string or a *TypeError if the operand is not a string.
+func (op *Operand) AsStringStrict() (string, error) {
+	if op.Type != otString {
+		return "", op.typeError("string")
+	}
+	return string(op.Str), nil
+}
+
+// AsBoolStrict returns the boolean or a *TypeError if the operand is not a boolean.
+func (op *Operand) AsBoolStrict() (bool, error) {
+	if op.Type != otBoolean {
+		return false, op.typeError("bool")
+	}
+	return op.Bool, nil
+}
+
+func (op *Operand) typeError(to string) error {
+	return &TypeError{From: op.Type, Value: op.String(), To: to}
+}
+
+func floatToInt(f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f >= math.MaxInt:
+		return math.MaxInt
+	case f <= math.MinInt:
+		return math.MinInt
+	}
+	return int(f)
+}
+
+// String returns the name of the operand type as used in error messages.
+// A set of types is rendered as "number or string".
+func (t OperandType) String() string {
+	if t&(t-1) != 0 {
+		names := make([]string, 0)
+		for bit := OperandType(1); bit != 0 && bit <= t; bit <<= 1 {
+			if t&bit != 0 {
+				names = append(names, bit.String())
+			}
+		}
+		return strings.Join(names, " or ")
+	}
+	switch t {
+	case otString:
+		return "string"
+	case otNumber:
+		return "number"
+	case otBoolean:
+		return "boolean"
+	case otNull:
+		return "null"
+	case otUndefined:
+		return "undefined"
+	case otRegexp:
+		return "regexp"
+	case otVariable:
+		return "variable"
+	case otObject:
+		return "object"
+	case otCustom:
+		return "custom"
+	}
+	return fmt.Sprintf("OperandType(%d)", uint16(t))
+}
+
+// timeToNumber returns milliseconds since the epoch like JavaScript Date.prototype.valueOf does.
+func timeToNumber(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}